@@ -1,184 +1,303 @@
 package assembler
 
 import (
+	"errors"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/alisdairrankine/frienvironment/vm"
 )
 
-func Assemble(program string) []byte {
+// Diagnostic describes a single problem found while assembling a program.
+type Diagnostic struct {
+	File    string
+	Line    int
+	Column  int
+	Token   string
+	Message string
+}
+
+func (d Diagnostic) Error() string {
+	file := d.File
+	if file == "" {
+		file = "<input>"
+	}
+	if d.Token == "" {
+		return fmt.Sprintf("%s:%d:%d: %s", file, d.Line, d.Column, d.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s %q", file, d.Line, d.Column, d.Message, d.Token)
+}
+
+// Diagnostics is the error returned by Assemble when a program has problems.
+// Every problem found is reported, not only the first.
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	lines := make([]string, len(d))
+	for i, diag := range d {
+		lines[i] = diag.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+var mnemonics = map[string]byte{}
+
+func init() {
+	for op, name := range vm.InstrName {
+		mnemonics[strings.ToLower(name)] = op
+	}
+}
+
+type token struct {
+	text   string
+	column int
+}
+
+type statement struct {
+	line    int
+	label   *token
+	op      *token
+	opcode  byte
+	operand []token
+}
+
+// Program is an assembled image along with the address of every label.
+type Program struct {
+	Code   []byte
+	Labels map[string]uint16
+}
+
+func Assemble(program string) ([]byte, error) {
+	return AssembleSource("", program)
+}
+
+// AssembleSource assembles program, naming file in any diagnostics reported.
+func AssembleSource(file, program string) ([]byte, error) {
+	p, err := AssembleProgram(file, program)
+	if err != nil {
+		return nil, err
+	}
+	return p.Code, nil
+}
+
+// AssembleProgram is like AssembleSource but also returns the label table.
+func AssembleProgram(file, program string) (*Program, error) {
+	var diags Diagnostics
+	var stmts []statement
+
+	// first pass: parse every line and work out where each label lands
+	labels := map[string]uint16{}
+	addr := vm.AddrProgramStart
+	for i, line := range strings.Split(program, "\n") {
+		stmt, errs := parseStatement(file, i+1, line)
+		diags = append(diags, errs...)
+		if stmt.label != nil {
+			if _, ok := labels[stmt.label.text]; ok {
+				diags = append(diags, stmt.diag(file, *stmt.label, "label defined twice"))
+			} else {
+				labels[stmt.label.text] = addr
+			}
+		}
+		if stmt.op != nil {
+			addr += uint16(1 + vm.InstrImmediate[stmt.opcode])
+			stmts = append(stmts, stmt)
+		}
+	}
+
+	// second pass: resolve label references and encode
 	out := []byte{}
-	for _, line := range strings.Split(program, "\n") {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "//") {
-			continue
+	for _, stmt := range stmts {
+		b, errs := stmt.encode(file, labels)
+		diags = append(diags, errs...)
+		out = append(out, b...)
+	}
+
+	if len(diags) > 0 {
+		sort.SliceStable(diags, func(i, j int) bool {
+			if diags[i].Line != diags[j].Line {
+				return diags[i].Line < diags[j].Line
+			}
+			return diags[i].Column < diags[j].Column
+		})
+		return nil, diags
+	}
+	return &Program{Code: out, Labels: labels}, nil
+}
+
+// ParseLine assembles a single line. Label references are not available.
+func ParseLine(line string) ([]byte, error) {
+	stmt, diags := parseStatement("", 1, line)
+	if stmt.op == nil {
+		if len(diags) > 0 {
+			return nil, diags
 		}
-		out = append(out, ParseLine(line)...)
+		return nil, nil
+	}
+	out, errs := stmt.encode("", nil)
+	diags = append(diags, errs...)
+	if len(diags) > 0 {
+		return nil, diags
 	}
-	return out
+	return out, nil
 }
 
-func ParseLine(line string) []byte {
-	var expect2Bytes bool
-	parts := strings.Split(line, " ")
-	out := []byte{}
-	switch strings.ToLower(parts[0]) {
-	case "yield":
-		out = append(out, vm.YieldInstruction)
-	case "halt":
-		out = append(out, vm.HaltInstruction)
-	case "dup":
-		out = append(out, vm.DupInstruction)
-	case "drop":
-		out = append(out, vm.DropInstruction)
-	case "swap":
-		out = append(out, vm.SwapInstruction)
-	case "rot":
-		out = append(out, vm.RotInstruction)
-	case "over":
-		out = append(out, vm.OverInstruction)
-	case "nip":
-		out = append(out, vm.NipInstruction)
-	case "tuck":
-		out = append(out, vm.TuckInstruction)
-	case "tor":
-		out = append(out, vm.ToRInstruction)
-	case "fromr":
-		out = append(out, vm.FromRInstruction)
-	case "fetchr":
-		out = append(out, vm.FetchRInstruction)
-	case "add":
-		out = append(out, vm.AddInstruction)
-	case "add16":
-		expect2Bytes = true
-		out = append(out, vm.Add16Instruction)
-	case "sub":
-		out = append(out, vm.SubInstruction)
-	case "sub16":
-		expect2Bytes = true
-		out = append(out, vm.Sub16Instruction)
-	case "mul":
-		out = append(out, vm.MulInstruction)
-	case "mul16":
-		expect2Bytes = true
-		out = append(out, vm.Mul16Instruction)
-	case "div":
-		out = append(out, vm.DivInstruction)
-	case "div16":
-		expect2Bytes = true
-		out = append(out, vm.Div16Instruction)
-	case "mod":
-		out = append(out, vm.ModInstruction)
-	case "mod16":
-		expect2Bytes = true
-		out = append(out, vm.Mod16Instruction)
-	case "and":
-		out = append(out, vm.AndInstruction)
-	case "and16":
-		expect2Bytes = true
-		out = append(out, vm.And16Instruction)
-	case "or":
-		out = append(out, vm.OrInstruction)
-	case "or16":
-		expect2Bytes = true
-		out = append(out, vm.Or16Instruction)
-	case "xor":
-		out = append(out, vm.XorInstruction)
-	case "xor16":
-		expect2Bytes = true
-		out = append(out, vm.Xor16Instruction)
-	case "not":
-		out = append(out, vm.NotInstruction)
-	case "not16":
-		expect2Bytes = true
-		out = append(out, vm.Not16Instruction)
-	case "inc":
-		out = append(out, vm.IncInstruction)
-	case "inc16":
-		expect2Bytes = true
-		out = append(out, vm.Inc16Instruction)
-	case "dec":
-		out = append(out, vm.DecInstruction)
-	case "dec16":
-		expect2Bytes = true
-		out = append(out, vm.Dec16Instruction)
-	case "shl":
-		out = append(out, vm.ShlInstruction)
-	case "shl16":
-		expect2Bytes = true
-		out = append(out, vm.Shl16Instruction)
-	case "shr":
-		out = append(out, vm.ShrInstruction)
-	case "shr16":
-		expect2Bytes = true
-		out = append(out, vm.Shr16Instruction)
-	case "jz":
-		out = append(out, vm.JzInstruction)
-	case "jnz":
-		out = append(out, vm.JnzInstruction)
-	case "call":
-		out = append(out, vm.CallInstruction)
-	case "ret":
-		out = append(out, vm.RetInstruction)
-	case "eq":
-		out = append(out, vm.EqInstruction)
-	case "eq16":
-		expect2Bytes = true
-		out = append(out, vm.Eq16Instruction)
-	case "nq":
-		out = append(out, vm.NqInstruction)
-	case "nq16":
-		expect2Bytes = true
-		out = append(out, vm.Nq16Instruction)
-	case "gt":
-		out = append(out, vm.GtInstruction)
-	case "gt16":
-		expect2Bytes = true
-		out = append(out, vm.Gt16Instruction)
-	case "lt":
-		out = append(out, vm.LtInstruction)
-	case "lt16":
-		expect2Bytes = true
-		out = append(out, vm.Lt16Instruction)
-	case "push":
-		out = append(out, vm.PushInstruction)
-	case "push16":
-		expect2Bytes = true
-		out = append(out, vm.Push16Instruction)
-	case "store":
-		out = append(out, vm.StoreInstruction)
-	case "store16":
-		out = append(out, vm.Store16Instruction)
-	case "load":
-		out = append(out, vm.LoadInstruction)
-	case "load16":
-		expect2Bytes = true
-		out = append(out, vm.Load16Instruction)
-	}
-
-	if len(parts) == 2 {
-		data := parts[1]
-
-		if strings.HasPrefix(data, "'") {
-			out = append(out, []byte(strings.Trim(data, "'"))...)
+func (s statement) diag(file string, t token, msg string) Diagnostic {
+	return Diagnostic{File: file, Line: s.line, Column: t.column, Token: t.text, Message: msg}
+}
+
+func parseStatement(file string, num int, line string) (statement, Diagnostics) {
+	stmt := statement{line: num}
+	var diags Diagnostics
 
+	tokens, err := tokenize(line)
+	if err != nil {
+		diags = append(diags, stmt.diag(file, *err, "unterminated character literal"))
+		return stmt, diags
+	}
+	if len(tokens) == 0 {
+		return stmt, nil
+	}
+
+	if name, ok := strings.CutSuffix(tokens[0].text, ":"); ok && !strings.HasPrefix(tokens[0].text, "'") {
+		label := token{text: name, column: tokens[0].column}
+		if !isLabel(name) {
+			diags = append(diags, stmt.diag(file, label, "invalid label name"))
 		} else {
-			base := 10
-			if strings.HasPrefix(data, "0x") {
-				data = strings.TrimPrefix(data, "0x")
-				base = 16
-			}
-			d, _ := strconv.ParseUint(data, base, 16)
-			if expect2Bytes {
-				high := byte((d & 0xFF00) >> 8)
-				out = append(out, high)
-			}
-			low := 0xFF & byte(d)
-			out = append(out, low)
+			stmt.label = &label
+		}
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return stmt, diags
+		}
+	}
+
+	op, ok := mnemonics[strings.ToLower(tokens[0].text)]
+	if !ok {
+		diags = append(diags, stmt.diag(file, tokens[0], "unknown instruction"))
+		return stmt, diags
+	}
+	stmt.op = &tokens[0]
+	stmt.opcode = op
+
+	args := tokens[1:]
+	if vm.InstrImmediate[op] > 0 {
+		if len(args) == 0 {
+			end := token{column: tokens[0].column + len(tokens[0].text)}
+			diags = append(diags, stmt.diag(file, end, "missing operand for "+tokens[0].text))
+		} else {
+			stmt.operand = args[:1]
+			args = args[1:]
+		}
+	}
+	for _, extra := range args {
+		diags = append(diags, stmt.diag(file, extra, "unexpected operand"))
+	}
+	return stmt, diags
+}
+
+func (s statement) encode(file string, labels map[string]uint16) ([]byte, Diagnostics) {
+	size := vm.InstrImmediate[s.opcode]
+	out := []byte{s.opcode}
+	if size == 0 {
+		return out, nil
+	}
+	if len(s.operand) == 0 {
+		return append(out, make([]byte, size)...), nil
+	}
 
+	arg := s.operand[0]
+	value, err := operandValue(arg.text, size, labels)
+	if err != nil {
+		return append(out, make([]byte, size)...), Diagnostics{s.diag(file, arg, err.Error())}
+	}
+	if size == 2 {
+		out = append(out, byte(value>>8))
+	}
+	return append(out, byte(value)), nil
+}
+
+func operandValue(text string, size int, labels map[string]uint16) (uint64, error) {
+	if strings.HasPrefix(text, "'") {
+		chars := []byte(strings.TrimSuffix(strings.TrimPrefix(text, "'"), "'"))
+		if len(chars) == 0 || len(chars) > size {
+			return 0, errors.New("character literal does not fit operand")
+		}
+		var v uint64
+		for _, c := range chars {
+			v = v<<8 | uint64(c)
 		}
+		return v, nil
 	}
 
-	return out
+	if isLabel(text) {
+		if size != 2 {
+			return 0, errors.New("label reference needs a 16 bit operand")
+		}
+		addr, ok := labels[text]
+		if !ok {
+			return 0, errors.New("undefined label")
+		}
+		return uint64(addr), nil
+	}
+
+	data, base := text, 10
+	if strings.HasPrefix(data, "0x") {
+		data = strings.TrimPrefix(data, "0x")
+		base = 16
+	}
+	v, err := strconv.ParseUint(data, base, size*8)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("literal out of range for %d bit operand", size*8)
+	}
+	if err != nil {
+		return 0, errors.New("invalid numeric literal")
+	}
+	return v, nil
+}
+
+// tokenize splits a line into whitespace separated tokens, stopping at a
+// "//" comment. Character literals may contain spaces.
+func tokenize(line string) ([]token, *token) {
+	var tokens []token
+	i := 0
+	for i < len(line) {
+		if line[i] == ' ' || line[i] == '\t' || line[i] == '\r' {
+			i++
+			continue
+		}
+		if strings.HasPrefix(line[i:], "//") {
+			break
+		}
+		start := i
+		if line[i] == '\'' {
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, &token{text: line[start:], column: start + 1}
+			}
+			i += end + 2
+		}
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' && line[i] != '\r' {
+			i++
+		}
+		tokens = append(tokens, token{text: line[start:i], column: start + 1})
+	}
+	return tokens, nil
+}
+
+func isLabel(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_', unicode.IsLetter(r):
+		case i > 0 && unicode.IsDigit(r):
+		default:
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,79 @@
+package assembler
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+func TestLabels(t *testing.T) {
+	src := `
+push16 end
+call
+start:
+push 1
+end: halt
+push16 start
+`
+	out, err := Assemble(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		vm.Push16Instruction, 0x04, 0x06,
+		vm.CallInstruction,
+		vm.PushInstruction, 0x01,
+		vm.HaltInstruction,
+		vm.Push16Instruction, 0x04, 0x04,
+	}
+	if !bytes.Equal(out, want) {
+		t.Fatalf("got % X, want % X", out, want)
+	}
+}
+
+func TestLabelErrors(t *testing.T) {
+	if _, err := Assemble("a:\nhalt\na:\n"); err == nil {
+		t.Error("expected error for duplicate label")
+	}
+	if _, err := Assemble("push16 missing\n"); err == nil {
+		t.Error("expected error for undefined label")
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	src := "push16 0x0400\nfrob\npush 256\npush\nhalt 1 2\npush 0xZZ"
+	_, err := AssembleSource("bad.ca", src)
+	var diags Diagnostics
+	if !errors.As(err, &diags) {
+		t.Fatalf("expected Diagnostics, got %v", err)
+	}
+	want := []Diagnostic{
+		{File: "bad.ca", Line: 2, Column: 1, Token: "frob", Message: "unknown instruction"},
+		{File: "bad.ca", Line: 3, Column: 6, Token: "256", Message: "literal out of range for 8 bit operand"},
+		{File: "bad.ca", Line: 4, Column: 5, Message: "missing operand for push"},
+		{File: "bad.ca", Line: 5, Column: 6, Token: "1", Message: "unexpected operand"},
+		{File: "bad.ca", Line: 5, Column: 8, Token: "2", Message: "unexpected operand"},
+		{File: "bad.ca", Line: 6, Column: 6, Token: "0xZZ", Message: "invalid numeric literal"},
+	}
+	if len(diags) != len(want) {
+		t.Fatalf("got %d diagnostics, want %d:\n%v", len(diags), len(want), diags)
+	}
+	for i := range want {
+		if diags[i] != want[i] {
+			t.Errorf("diagnostic %d: got %+v, want %+v", i, diags[i], want[i])
+		}
+	}
+}
+
+func TestCharacterLiterals(t *testing.T) {
+	out, err := Assemble("push ' ' // space\npush16 'Hi'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{vm.PushInstruction, ' ', vm.Push16Instruction, 'H', 'i'}
+	if !bytes.Equal(out, want) {
+		t.Fatalf("got % X, want % X", out, want)
+	}
+}
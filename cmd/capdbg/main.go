@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/alisdairrankine/frienvironment/assembler"
+	"github.com/alisdairrankine/frienvironment/devices"
+	"github.com/alisdairrankine/frienvironment/disassembler"
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+const help = `commands:
+  s, step [n]            execute n instructions (default 1)
+  n, next                step, running over CALL until it returns
+  c, continue            run until a breakpoint, watchpoint, halt or fault
+  b, break <label|addr>  set a breakpoint
+  d, delete <label|addr> remove a breakpoint
+  w, watch <label|addr> [r|w|rw]
+                         pause when memory is read or written
+  p, print stack|rstack  show the data or return stack
+  x <label|addr> [len]   examine memory
+  f, flags               show the decoded status flags
+  l, dis [n]             disassemble n instructions around the PC
+  i, info                show the PC, stack pointers and breakpoints
+  q, quit                exit`
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: capdbg <program.ca>")
+		os.Exit(2)
+	}
+	src, err := os.ReadFile(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	prog, err := assembler.AssembleProgram(os.Args[1], string(src))
+	if err != nil {
+		var diags assembler.Diagnostics
+		if errors.As(err, &diags) {
+			for _, d := range diags {
+				fmt.Fprintln(os.Stderr, d)
+			}
+			os.Exit(1)
+		}
+		log.Fatal(err)
+	}
+
+	m := vm.New()
+	m.LoadProgram(prog.Code)
+	m.RegisterDevice(1, devices.NewTerminal(m, 1))
+	m.Reset()
+
+	d := newDebugger(m, prog, os.Stdout)
+	d.repl(os.Stdin)
+}
+
+type debugger struct {
+	m       *vm.VM
+	prog    *assembler.Program
+	symbols map[uint16]string
+	out     io.Writer
+}
+
+func newDebugger(m *vm.VM, prog *assembler.Program, out io.Writer) *debugger {
+	d := &debugger{
+		m:       m,
+		prog:    prog,
+		symbols: map[uint16]string{},
+		out:     out,
+	}
+	for name, addr := range prog.Labels {
+		if other, ok := d.symbols[addr]; !ok || name < other {
+			d.symbols[addr] = name
+		}
+	}
+	return d
+}
+
+func (d *debugger) repl(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	d.where()
+	for {
+		fmt.Fprint(d.out, "(capdbg) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(d.out)
+			return
+		}
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "q" || args[0] == "quit" {
+			return
+		}
+		if err := d.command(args[0], args[1:]); err != nil {
+			fmt.Fprintln(d.out, "error:", err)
+		}
+	}
+}
+
+func (d *debugger) command(cmd string, args []string) error {
+	switch cmd {
+	case "h", "help":
+		fmt.Fprintln(d.out, help)
+	case "s", "step":
+		n := 1
+		if len(args) > 0 {
+			v, err := strconv.Atoi(args[0])
+			if err != nil || v < 1 {
+				return fmt.Errorf("bad count %q", args[0])
+			}
+			n = v
+		}
+		var stop vm.Stop
+		for i := 0; i < n; i++ {
+			if stop = d.m.Step(); stop.Reason != vm.StopStep {
+				break
+			}
+		}
+		d.report(stop)
+	case "n", "next":
+		d.report(d.next())
+	case "c", "continue":
+		d.report(d.m.Continue())
+	case "b", "break":
+		addr, err := d.addrArg(args)
+		if err != nil {
+			return err
+		}
+		d.m.SetBreakpoint(addr)
+		fmt.Fprintf(d.out, "breakpoint at %s\n", d.name(addr))
+	case "d", "delete":
+		addr, err := d.addrArg(args)
+		if err != nil {
+			return err
+		}
+		d.m.ClearBreakpoint(addr)
+	case "w", "watch":
+		addr, err := d.addrArg(args)
+		if err != nil {
+			return err
+		}
+		access := vm.AccessWrite
+		if len(args) > 1 {
+			switch args[1] {
+			case "r":
+				access = vm.AccessRead
+			case "w":
+				access = vm.AccessWrite
+			case "rw":
+				access = vm.AccessRead | vm.AccessWrite
+			default:
+				return fmt.Errorf("bad access %q, want r, w or rw", args[1])
+			}
+		}
+		d.m.SetWatchpoint(addr, access)
+		fmt.Fprintf(d.out, "watching %s for %s\n", d.name(addr), access)
+	case "p", "print":
+		if len(args) != 1 {
+			return errors.New("print stack|rstack")
+		}
+		return d.print(args[0])
+	case "x":
+		return d.examine(args)
+	case "f", "flags":
+		d.flags()
+	case "l", "dis":
+		n := 10
+		if len(args) > 0 {
+			v, err := strconv.Atoi(args[0])
+			if err != nil || v < 1 {
+				return fmt.Errorf("bad count %q", args[0])
+			}
+			n = v
+		}
+		d.disassemble(n)
+	case "i", "info":
+		d.info()
+	default:
+		return fmt.Errorf("unknown command %q, try help", cmd)
+	}
+	return nil
+}
+
+// next steps over CALL by running to the instruction after it.
+func (d *debugger) next() vm.Stop {
+	pc := d.m.State().PC
+	if d.m.MMIO.ReadData(pc, 1)[0] != vm.CallInstruction {
+		return d.m.Step()
+	}
+	ret := pc + 1
+	temporary := !d.hasBreakpoint(ret)
+	d.m.SetBreakpoint(ret)
+	stop := d.m.Continue()
+	if temporary {
+		d.m.ClearBreakpoint(ret)
+	}
+	return stop
+}
+
+func (d *debugger) hasBreakpoint(addr uint16) bool {
+	for _, b := range d.m.Breakpoints() {
+		if b == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *debugger) report(stop vm.Stop) {
+	switch stop.Reason {
+	case vm.StopWatchpoint:
+		fmt.Fprintf(d.out, "watchpoint: %s of 0x%02X at %s\n", stop.Watch.Access, stop.Watch.Value, d.name(stop.Watch.Addr))
+	case vm.StopWaiting:
+		fmt.Fprintln(d.out, "waiting for an interrupt")
+	case vm.StopFaulted:
+		fmt.Fprintf(d.out, "faulted: %s\n", stop.State.Fault)
+	case vm.StopHalted:
+		fmt.Fprintln(d.out, "halted")
+	case vm.StopBreakpoint:
+		fmt.Fprintln(d.out, "breakpoint")
+	}
+	d.where()
+}
+
+func (d *debugger) where() {
+	pc := d.m.State().PC
+	fmt.Fprintf(d.out, "=> %s\n", disassembler.FormatLine(d.decode(pc)))
+}
+
+func (d *debugger) decode(addr uint16) disassembler.Instruction {
+	n := 3
+	if int(addr)+n > 0x10000 {
+		n = 0x10000 - int(addr)
+	}
+	return disassembler.DecodeAt(d.m.MMIO.ReadData(addr, n), 0, addr)
+}
+
+func (d *debugger) print(what string) error {
+	state := d.m.State()
+	switch what {
+	case "stack":
+		fmt.Fprintf(d.out, "stack (%d): %s\n", len(state.Stack), hex(state.Stack))
+	case "rstack":
+		addrs := make([]string, 0)
+		for _, a := range state.ReturnAddresses() {
+			addrs = append(addrs, d.name(a))
+		}
+		fmt.Fprintf(d.out, "rstack (%d): %s\n", len(state.ReturnStack), hex(state.ReturnStack))
+		if len(addrs) > 0 {
+			fmt.Fprintf(d.out, "  as addresses: %s\n", strings.Join(addrs, " "))
+		}
+	default:
+		return fmt.Errorf("print stack|rstack, not %q", what)
+	}
+	return nil
+}
+
+func (d *debugger) examine(args []string) error {
+	addr, err := d.addrArg(args)
+	if err != nil {
+		return err
+	}
+	length := 16
+	if len(args) > 1 {
+		v, err := strconv.ParseUint(args[1], 0, 16)
+		if err != nil || v == 0 {
+			return fmt.Errorf("bad length %q", args[1])
+		}
+		length = int(v)
+	}
+	if int(addr)+length > 0x10000 {
+		length = 0x10000 - int(addr)
+	}
+	data := d.m.MMIO.ReadData(addr, length)
+	for i := 0; i < len(data); i += 16 {
+		line := data[i:min(i+16, len(data))]
+		printable := make([]byte, len(line))
+		for j, b := range line {
+			printable[j] = '.'
+			if b >= 0x20 && b < 0x7F {
+				printable[j] = b
+			}
+		}
+		fmt.Fprintf(d.out, "%04X  %-47s  %s\n", int(addr)+i, hex(line), printable)
+	}
+	return nil
+}
+
+func (d *debugger) flags() {
+	state := d.m.State()
+	flags := state.Flags()
+	if len(flags) == 0 {
+		flags = []string{"none"}
+	}
+	fmt.Fprintf(d.out, "status 0x%02X: %s\n", state.Status, strings.Join(flags, ", "))
+	if state.Status&vm.FlagFault != 0 {
+		fmt.Fprintf(d.out, "fault: %s\n", state.Fault)
+	}
+}
+
+// disassemble shows n instructions around the PC, decoding from the start of
+// the program image so instruction boundaries line up.
+func (d *debugger) disassemble(n int) {
+	pc := d.m.State().PC
+	start := vm.AddrProgramStart
+	end := int(start) + len(d.prog.Code)
+	if pc < start || int(pc) >= end {
+		start, end = pc, min(int(pc)+3*n, 0x10000)
+	}
+	instrs := disassembler.Decode(d.m.MMIO.ReadData(start, end-int(start)), start)
+
+	at := 0
+	for i, instr := range instrs {
+		if instr.Addr <= pc {
+			at = i
+		}
+	}
+	from := max(0, at-n/2)
+	to := min(len(instrs), from+n)
+	for _, instr := range instrs[from:to] {
+		if name, ok := d.symbols[instr.Addr]; ok {
+			fmt.Fprintf(d.out, "%s:\n", name)
+		}
+		marker := "  "
+		if instr.Addr == pc {
+			marker = "=>"
+		}
+		if d.hasBreakpoint(instr.Addr) {
+			marker = "b" + marker[1:]
+		}
+		fmt.Fprintf(d.out, "%s %s\n", marker, disassembler.FormatLine(instr))
+	}
+}
+
+func (d *debugger) info() {
+	state := d.m.State()
+	fmt.Fprintf(d.out, "pc 0x%04X  sp 0x%02X  rsp 0x%02X  cycles %d\n",
+		state.PC, len(state.Stack), len(state.ReturnStack), state.Cycles)
+	d.flags()
+	var bps []string
+	for _, b := range d.m.Breakpoints() {
+		bps = append(bps, d.name(b))
+	}
+	if len(bps) > 0 {
+		fmt.Fprintf(d.out, "breakpoints: %s\n", strings.Join(bps, " "))
+	}
+}
+
+func (d *debugger) addrArg(args []string) (uint16, error) {
+	if len(args) == 0 {
+		return 0, errors.New("missing address")
+	}
+	if addr, ok := d.prog.Labels[args[0]]; ok {
+		return addr, nil
+	}
+	v, err := strconv.ParseUint(args[0], 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown label or address %q", args[0])
+	}
+	return uint16(v), nil
+}
+
+// name renders an address, with its label when it has one.
+func (d *debugger) name(addr uint16) string {
+	if name, ok := d.symbols[addr]; ok {
+		return fmt.Sprintf("0x%04X <%s>", addr, name)
+	}
+	// show the nearest preceding label inside the program as an offset
+	var best string
+	var bestAddr uint16
+	for a, name := range d.symbols {
+		if a < addr && a >= bestAddr {
+			best, bestAddr = name, a
+		}
+	}
+	if best != "" && int(addr) < int(vm.AddrProgramStart)+len(d.prog.Code) {
+		return fmt.Sprintf("0x%04X <%s+%d>", addr, best, addr-bestAddr)
+	}
+	return fmt.Sprintf("0x%04X", addr)
+}
+
+func hex(data []byte) string {
+	parts := make([]string, len(data))
+	for i, b := range data {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/alisdairrankine/frienvironment/disassembler"
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+func main() {
+	source := flag.Bool("source", false, "emit assembler source instead of a listing")
+	length := flag.Int("n", 0, "number of bytes to decode (default: all)")
+	at := flag.Uint("at", uint(vm.AddrProgramStart), "address to start decoding a full memory dump from")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: capdis [-source] [-n bytes] [-at addr] <image|dump.hex>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *at > 0xFFFF {
+		fmt.Fprintf(os.Stderr, "capdis: -at %d is past the end of memory\n", *at)
+		os.Exit(2)
+	}
+
+	data, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// a full 64KiB memory dump is addressed directly, anything else is a
+	// program image loaded at the start of working memory
+	code, origin := data, vm.AddrProgramStart
+	if len(data) == 65536 {
+		origin = uint16(*at)
+		code = data[origin:]
+	}
+	if *length > 0 && *length < len(code) {
+		code = code[:*length]
+	}
+
+	if *source {
+		src, err := disassembler.Source(code)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(src)
+		return
+	}
+	if err := disassembler.Listing(os.Stdout, code, origin); err != nil {
+		log.Fatal(err)
+	}
+}
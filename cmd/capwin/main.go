@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/alisdairrankine/frienvironment/devices"
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+func main() {
+	width := flag.Int("width", 640, "width of the composited frame")
+	height := flag.Int("height", 400, "height of the composited frame")
+	fps := flag.Int("fps", 30, "frames per second")
+	out := flag.String("png", "", "run without a window and write the last frame to `file`")
+	frames := flag.Int("frames", 30, "frames to run for without a window")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: capwin [flags] <program>...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// every program gets a terminal in slot 1, graphics in slot 4 and input
+	// in slot 8; the first also gets the screen, in slot 7
+	sys := devices.NewSystem()
+	defer sys.Close()
+	var screen *devices.Screen
+	for i, name := range flag.Args() {
+		program, err := devices.LoadProgramFile(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = sys.Spawn(program, func(m *vm.VM) {
+			m.RegisterDevice(1, devices.NewTerminal(m, 1))
+			m.RegisterDevice(4, devices.NewGraphics(m))
+			m.RegisterDevice(8, devices.NewInputDevice(m, 8))
+			if i == 0 {
+				screen = devices.NewScreen(m, devices.ScreenWidth, devices.ScreenHeight)
+				m.RegisterDevice(7, screen)
+			}
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	f := &devices.Frontend{
+		Compositor: devices.NewCompositor(sys, *width, *height),
+		Screen:     screen,
+	}
+	interval := time.Second / time.Duration(max(*fps, 1))
+
+	if *out != "" {
+		headless := devices.NewHeadlessDisplay()
+		f.Display = headless
+		for range *frames {
+			if _, err := f.Step(); err != nil {
+				log.Fatal(err)
+			}
+			time.Sleep(interval)
+		}
+		file, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := headless.WritePNG(file); err != nil {
+			log.Fatal(err)
+		}
+		if err := file.Close(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	window, err := openWindow(max(*width, 8*devices.ScreenWidth), *height+8*devices.ScreenHeight, "capwin")
+	if err != nil {
+		log.Fatal(err)
+	}
+	f.Display = window
+	if err := f.Run(context.Background(), interval); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !raylib
+
+package main
+
+import (
+	"errors"
+
+	"github.com/alisdairrankine/frienvironment/devices"
+)
+
+func openWindow(width, height int, title string) (devices.Display, error) {
+	return nil, errors.New("capwin was built without a window; rebuild with -tags raylib, or use -png")
+}
@@ -0,0 +1,144 @@
+//go:build raylib
+
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"runtime"
+	"unsafe"
+
+	rl "github.com/gen2brain/raylib-go/raylib"
+
+	"github.com/alisdairrankine/frienvironment/devices"
+)
+
+func init() {
+	// raylib must be called from the main thread
+	runtime.LockOSThread()
+}
+
+// window is a raylib window. Raylib's keycodes are the ones the input device
+// uses, so keys are passed on as they are.
+type window struct {
+	texture rl.Texture2D
+	size    image.Point
+	held    map[int32]bool
+	mouse   image.Point
+}
+
+func openWindow(width, height int, title string) (devices.Display, error) {
+	rl.SetTraceLogLevel(rl.LogWarning)
+	rl.InitWindow(int32(width), int32(height), title)
+	if !rl.IsWindowReady() {
+		return nil, errors.New("could not open a window")
+	}
+	// escape goes to the VMs rather than closing the window
+	rl.SetExitKey(0)
+	return &window{held: map[int32]bool{}}, nil
+}
+
+func (w *window) Present(frame *image.RGBA) error {
+	if size := frame.Rect.Size(); size != w.size {
+		if w.size != (image.Point{}) {
+			rl.UnloadTexture(w.texture)
+		}
+		img := rl.GenImageColor(size.X, size.Y, rl.Black)
+		w.texture = rl.LoadTextureFromImage(img)
+		rl.UnloadImage(img)
+		w.size = size
+	}
+	if len(frame.Pix) > 0 {
+		rl.UpdateTexture(w.texture, unsafe.Slice((*color.RGBA)(unsafe.Pointer(&frame.Pix[0])), len(frame.Pix)/4))
+	}
+	rl.BeginDrawing()
+	rl.ClearBackground(rl.Black)
+	rl.DrawTexture(w.texture, 0, 0, rl.White)
+	rl.EndDrawing()
+	return nil
+}
+
+var modifiers = []struct {
+	keys [2]int32
+	mod  byte
+}{
+	{[2]int32{rl.KeyLeftShift, rl.KeyRightShift}, devices.ModShift},
+	{[2]int32{rl.KeyLeftControl, rl.KeyRightControl}, devices.ModCtrl},
+	{[2]int32{rl.KeyLeftAlt, rl.KeyRightAlt}, devices.ModAlt},
+	{[2]int32{rl.KeyLeftSuper, rl.KeyRightSuper}, devices.ModSuper},
+}
+
+var buttons = []rl.MouseButton{rl.MouseButtonLeft, rl.MouseButtonRight, rl.MouseButtonMiddle}
+
+func (w *window) Poll() ([]devices.InputEvent, bool) {
+	if rl.WindowShouldClose() {
+		return nil, false
+	}
+	var mods byte
+	for _, m := range modifiers {
+		if rl.IsKeyDown(m.keys[0]) || rl.IsKeyDown(m.keys[1]) {
+			mods |= m.mod
+		}
+	}
+
+	var events []devices.InputEvent
+	var chars []byte
+	for c := rl.GetCharPressed(); c != 0; c = rl.GetCharPressed() {
+		if c < 0x7F {
+			chars = append(chars, byte(c))
+		}
+	}
+	for k := rl.GetKeyPressed(); k != 0; k = rl.GetKeyPressed() {
+		ev := devices.InputEvent{Kind: devices.InputKeyDown, Key: uint16(k), Mods: mods}
+		switch {
+		case k == rl.KeyEnter:
+			ev.Char = '\n'
+		case k == rl.KeyBackspace:
+			ev.Char = '\b'
+		case k == rl.KeyTab:
+			ev.Char = '\t'
+		case k >= 0x20 && k < 0x7F && len(chars) > 0:
+			ev.Char, chars = chars[0], chars[1:]
+		}
+		w.held[k] = true
+		events = append(events, ev)
+	}
+	for k := range w.held {
+		if !rl.IsKeyDown(k) {
+			delete(w.held, k)
+			events = append(events, devices.InputEvent{Kind: devices.InputKeyUp, Key: uint16(k), Mods: mods})
+		}
+	}
+
+	pos := rl.GetMousePosition()
+	mouse := image.Pt(int(pos.X), int(pos.Y))
+	if mouse != w.mouse {
+		w.mouse = mouse
+		events = append(events, devices.InputEvent{Kind: devices.InputMouseMove, Mods: mods, X: mouse.X, Y: mouse.Y})
+	}
+	for i, b := range buttons {
+		ev := devices.InputEvent{Button: byte(i + 1), Mods: mods, X: mouse.X, Y: mouse.Y}
+		switch {
+		case rl.IsMouseButtonPressed(b):
+			ev.Kind = devices.InputButtonDown
+		case rl.IsMouseButtonReleased(b):
+			ev.Kind = devices.InputButtonUp
+		default:
+			continue
+		}
+		events = append(events, ev)
+	}
+	if v := rl.GetMouseWheelMoveV(); v.X != 0 || v.Y != 0 {
+		events = append(events, devices.InputEvent{Kind: devices.InputScroll, Mods: mods, X: int(v.X), Y: int(v.Y)})
+	}
+	return events, true
+}
+
+func (w *window) Close() error {
+	if w.size != (image.Point{}) {
+		rl.UnloadTexture(w.texture)
+	}
+	rl.CloseWindow()
+	return nil
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
-	"time"
+	"strings"
+	"sync"
 
 	"github.com/alisdairrankine/frienvironment/assembler"
 	"github.com/alisdairrankine/frienvironment/devices"
@@ -12,30 +16,99 @@ import (
 )
 
 func main() {
+	record := flag.String("record", "", "write a recording of every VM's inputs to `file`")
+	replay := flag.String("replay", "", "replay the recording in `file` instead of running live")
+	flag.Parse()
 
 	sender, err := LoadProgram("progs/sender.ca")
 	if err != nil {
-		log.Fatal(err)
+		exitWithError(err)
 	}
 
 	receiver, err := LoadProgram("progs/receiver.ca")
 	if err != nil {
-		log.Fatal(err)
+		exitWithError(err)
+	}
+
+	// wait for every machine to halt or fault rather than for a fixed time
+	var wg sync.WaitGroup
+	waitForStop := func(m *vm.VM) {
+		wg.Add(1)
+		m.OnStop(func(stop vm.Stop) {
+			switch stop.Reason {
+			case vm.StopFaulted:
+				fmt.Fprintf(os.Stderr, "vm faulted at 0x%04X: %s\n", stop.State.PC, strings.Join(stop.State.Flags(), ", "))
+				wg.Done()
+			case vm.StopHalted:
+				wg.Done()
+			}
+		})
 	}
 
 	sys := devices.NewSystem()
+	var recorder *devices.Recorder
+	switch {
+	case *replay != "":
+		rec, err := readRecording(*replay)
+		if err != nil {
+			exitWithError(err)
+		}
+		sys.Replay(rec)
+	case *record != "":
+		recorder = devices.NewRecorder()
+		sys.Record(recorder)
+	}
+
 	netSwitch := devices.NewSwitch()
-	sys.Spawn(receiver, func(vm *vm.VM) {
+	_, err = sys.Spawn(receiver, waitForStop, func(vm *vm.VM) {
 		netSwitch.Attach(0, vm)
-		vm.RegisterDevice(1, devices.NewTerminal(vm))
+		vm.RegisterDevice(1, devices.NewTerminal(vm, 1))
 		// vm.Debug = true
 	})
-	sys.Spawn(sender, func(vm *vm.VM) {
+	if err != nil {
+		exitWithError(err)
+	}
+	_, err = sys.Spawn(sender, waitForStop, func(vm *vm.VM) {
 		netSwitch.Attach(0, vm)
 
 	})
+	if err != nil {
+		exitWithError(err)
+	}
+
+	wg.Wait()
+
+	if *replay != "" {
+		if err := sys.WaitReplay(); err != nil {
+			exitWithError(err)
+		}
+	}
+	if recorder != nil {
+		if err := writeRecording(*record, recorder.Recording()); err != nil {
+			exitWithError(err)
+		}
+	}
+}
 
-	time.Sleep(100 * time.Second)
+func readRecording(filename string) (*devices.Recording, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return devices.ReadRecording(f)
+}
+
+func writeRecording(filename string, rec *devices.Recording) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := rec.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 func LoadProgram(filename string) ([]byte, error) {
@@ -48,5 +121,16 @@ func LoadProgram(filename string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return assembler.Assemble(string(data)), nil
+	return assembler.AssembleSource(filename, string(data))
+}
+
+func exitWithError(err error) {
+	var diags assembler.Diagnostics
+	if errors.As(err, &diags) {
+		for _, d := range diags {
+			fmt.Fprintln(os.Stderr, d)
+		}
+		os.Exit(1)
+	}
+	log.Fatal(err)
 }
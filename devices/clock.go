@@ -0,0 +1,376 @@
+package devices
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+const ClockDeviceType = 0x03
+
+// ClockTimers is the number of timers on each clock.
+const ClockTimers = 4
+
+/**
+Clock Device
+
+Time only changes when the VM latches it, by writing bit 7 of status, so that
+every register read between latches agrees. Timers raise the clock's
+interrupt each time they expire and set their bit in status.
+
+Reg  Addr   Name              R/W   Description
+---  ----   ----              ---   -----------
+0    0x00   device_type       R     0x03 = clock
+1    0x01   status            RW    bits 0-3: timers that expired, write 1 to clear; write bit 7 to latch
+2    0x02   ticks_3           R     milliseconds since the clock started, big endian
+3    0x03   ticks_2           R
+4    0x04   ticks_1           R
+5    0x05   ticks_0           R
+6    0x06   wall_3            R     wall clock time in Unix seconds, big endian
+7    0x07   wall_2            R
+8    0x08   wall_1            R
+9    0x09   wall_0            R
+10   0x0A   timer_select      RW    timer addressed by period and timer_control, 0-3
+11   0x0B   callback_high     RW
+12   0x0C   callback_low      RW
+13   0x0D   period_high       RW    period of the selected timer in milliseconds
+14   0x0E   period_low        RW
+15   0x0F   timer_control     RW    bit 0 armed, bit 1 periodic; writing restarts the timer
+
+A one-shot timer disarms itself when it expires.
+**/
+
+// TimeSource supplies the time to clocks.
+type TimeSource interface {
+	Now() time.Time
+	// AfterFunc calls f on its own goroutine once d has passed. The returned
+	// function cancels the call.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// RealTime is the host's clock.
+type RealTime struct{}
+
+func (RealTime) Now() time.Time {
+	return time.Now()
+}
+
+func (RealTime) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// VirtualClock is a TimeSource that only moves when advanced, so tests can
+// control exactly when timers expire.
+type VirtualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers []*virtualTimer
+}
+
+type virtualTimer struct {
+	at  time.Time
+	seq uint64
+	f   func()
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) func() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &virtualTimer{at: c.now.Add(d), seq: c.seq, f: f}
+	c.seq++
+	c.timers = append(c.timers, t)
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, other := range c.timers {
+			if other == t {
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Advance moves the clock forward by d, calling the functions of timers that
+// expire in the order they expire, on the calling goroutine. Timers started
+// by those functions are run too if they expire in time.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.Slice(c.timers, func(i, j int) bool {
+			if !c.timers[i].at.Equal(c.timers[j].at) {
+				return c.timers[i].at.Before(c.timers[j].at)
+			}
+			return c.timers[i].seq < c.timers[j].seq
+		})
+		if len(c.timers) == 0 || c.timers[0].at.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = t.at
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+type clockTimer struct {
+	period   uint16
+	armed    bool
+	periodic bool
+	gen      uint64 // bumped whenever the timer is restarted, to ignore stale expiries
+	stop     func() bool
+}
+
+type Clock struct {
+	vm       *vm.VM
+	source   TimeSource
+	start    time.Time
+	deviceID int
+
+	// latched time and expired timers, only changed by inputs
+	ticks   uint32
+	wall    uint32
+	expired byte
+
+	selected     byte
+	callbackAddr uint16
+
+	// timers are guarded by mu as they expire on other goroutines
+	mu     sync.Mutex
+	timers [ClockTimers]clockTimer
+}
+
+// NewClock returns a clock for vm, registered as device deviceNum, that
+// counts ticks from now by source.
+func NewClock(vm *vm.VM, deviceNum int, source TimeSource) *Clock {
+	return &Clock{
+		vm:       vm,
+		source:   source,
+		start:    source.Now(),
+		deviceID: deviceNum,
+	}
+}
+
+func (c *Clock) Write(addr uint16, data byte) {
+	switch addr & 0x000F {
+	case 0x01:
+		c.expired &^= data & 0x0F
+		if data&0x80 != 0 {
+			now := c.source.Now()
+			c.vm.Deliver(ClockLatch{
+				Slot:  c.deviceID,
+				Ticks: uint32(now.Sub(c.start).Milliseconds()),
+				Wall:  uint32(now.Unix()),
+			})
+		}
+	case 0x0A:
+		c.selected = data % ClockTimers
+	case 0x0B:
+		c.callbackAddr = (uint16(data) << 8) | (c.callbackAddr & 0x00FF)
+	case 0x0C:
+		c.callbackAddr = (uint16(data)) | (c.callbackAddr & 0xFF00)
+	case 0x0D:
+		c.mu.Lock()
+		t := &c.timers[c.selected]
+		t.period = (uint16(data) << 8) | (t.period & 0x00FF)
+		c.mu.Unlock()
+	case 0x0E:
+		c.mu.Lock()
+		t := &c.timers[c.selected]
+		t.period = (uint16(data)) | (t.period & 0xFF00)
+		c.mu.Unlock()
+	case 0x0F:
+		c.mu.Lock()
+		c.arm(int(c.selected), data&0x01 != 0, data&0x02 != 0)
+		c.mu.Unlock()
+	}
+}
+
+func (c *Clock) Read(addr uint16) byte {
+	switch addr & 0x000F {
+	case 0x00:
+		return ClockDeviceType
+	case 0x01:
+		return c.expired
+	case 0x02, 0x03, 0x04, 0x05:
+		return byte(c.ticks >> (8 * (5 - addr&0x000F)))
+	case 0x06, 0x07, 0x08, 0x09:
+		return byte(c.wall >> (8 * (9 - addr&0x000F)))
+	case 0x0A:
+		return c.selected
+	case 0x0B:
+		return byte(c.callbackAddr >> 8)
+	case 0x0C:
+		return byte(c.callbackAddr & 0x00FF)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.timers[c.selected]
+	switch addr & 0x000F {
+	case 0x0D:
+		return byte(t.period >> 8)
+	case 0x0E:
+		return byte(t.period & 0x00FF)
+	case 0x0F:
+		var control byte
+		if t.armed {
+			control |= 0x01
+		}
+		if t.periodic {
+			control |= 0x02
+		}
+		return control
+	}
+	return 0
+}
+
+// arm restarts timer n. The caller holds c.mu.
+func (c *Clock) arm(n int, armed, periodic bool) {
+	t := &c.timers[n]
+	if t.stop != nil {
+		t.stop()
+		t.stop = nil
+	}
+	t.gen++
+	t.armed, t.periodic = armed, periodic
+	if armed {
+		c.schedule(n, c.source.Now().Add(c.period(t)))
+	}
+}
+
+func (c *Clock) period(t *clockTimer) time.Duration {
+	return time.Duration(max(t.period, 1)) * time.Millisecond
+}
+
+// schedule sets timer n to expire at deadline. The caller holds c.mu.
+func (c *Clock) schedule(n int, deadline time.Time) {
+	t := &c.timers[n]
+	gen := t.gen
+	t.stop = c.source.AfterFunc(deadline.Sub(c.source.Now()), func() {
+		c.expire(n, gen, deadline)
+	})
+}
+
+func (c *Clock) expire(n int, gen uint64, deadline time.Time) {
+	c.mu.Lock()
+	t := &c.timers[n]
+	if t.gen != gen || !t.armed {
+		c.mu.Unlock()
+		return
+	}
+	if t.periodic {
+		// count from the deadline rather than now so periods don't drift
+		c.schedule(n, deadline.Add(c.period(t)))
+	} else {
+		t.armed = false
+		t.stop = nil
+	}
+	c.mu.Unlock()
+
+	c.vm.Deliver(ClockTick{Slot: c.deviceID, Timer: n})
+	c.vm.RaiseInterrupt(c.deviceID)
+}
+
+// Stop disarms every timer. The clocks of a System's VMs are stopped when
+// the VM ends; stop the clock of any other VM once it is done with.
+func (c *Clock) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n := range c.timers {
+		c.arm(n, false, false)
+	}
+}
+
+// SaveState saves the registers and timer settings. Armed timers restart
+// their period when the state is loaded.
+func (c *Clock) SaveState() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data := []byte{
+		c.expired, c.selected,
+		byte(c.ticks >> 24), byte(c.ticks >> 16), byte(c.ticks >> 8), byte(c.ticks),
+		byte(c.wall >> 24), byte(c.wall >> 16), byte(c.wall >> 8), byte(c.wall),
+		byte(c.callbackAddr >> 8), byte(c.callbackAddr),
+	}
+	for _, t := range c.timers {
+		var control byte
+		if t.armed {
+			control |= 0x01
+		}
+		if t.periodic {
+			control |= 0x02
+		}
+		data = append(data, byte(t.period>>8), byte(t.period), control)
+	}
+	return data, nil
+}
+
+func (c *Clock) LoadState(data []byte) error {
+	if len(data) != 12+3*ClockTimers {
+		return errors.New("clock: bad state length")
+	}
+	c.expired, c.selected = data[0], data[1]%ClockTimers
+	c.ticks = uint32(data[2])<<24 | uint32(data[3])<<16 | uint32(data[4])<<8 | uint32(data[5])
+	c.wall = uint32(data[6])<<24 | uint32(data[7])<<16 | uint32(data[8])<<8 | uint32(data[9])
+	c.callbackAddr = uint16(data[10])<<8 | uint16(data[11])
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n := range c.timers {
+		timer := data[12+3*n:]
+		c.timers[n].period = uint16(timer[0])<<8 | uint16(timer[1])
+		c.arm(n, timer[2]&0x01 != 0, timer[2]&0x02 != 0)
+	}
+	return nil
+}
+
+// ClockLatch is the input applied to a VM when it latches the time of the
+// clock in Slot.
+type ClockLatch struct {
+	Slot  int
+	Ticks uint32
+	Wall  uint32
+}
+
+func (l ClockLatch) Apply(m *vm.VM) {
+	c, ok := m.Device(l.Slot).(*Clock)
+	if !ok {
+		return
+	}
+	c.ticks = l.Ticks
+	c.wall = l.Wall
+}
+
+// ClockTick is the input applied to a VM when a timer of the clock in Slot
+// expires.
+type ClockTick struct {
+	Slot  int
+	Timer int
+}
+
+func (t ClockTick) Apply(m *vm.VM) {
+	c, ok := m.Device(t.Slot).(*Clock)
+	if !ok {
+		return
+	}
+	c.expired |= 1 << t.Timer
+}
@@ -0,0 +1,153 @@
+package devices
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+// timerProgram starts timer 2 with a 10ms period, counts its interrupts at
+// 0x1000 and collects the expired timers at 0x1001
+const timerProgram = `
+push16 0x031B
+push16 on_tick
+store16
+push16 0x031A
+push 2
+store
+push16 0x031D
+push16 10
+store16
+push16 0x031F
+push %d
+store
+yield
+
+on_tick:
+push16 0x1000
+push16 0x1000
+load
+inc
+store
+push16 0x1001
+push16 0x1001
+load
+push16 0x0311
+load
+or
+store
+push16 0x0311
+push 0x04
+store
+reti
+`
+
+func newClockVM(t *testing.T, src string, clock *VirtualClock) (*vm.VM, *Clock) {
+	t.Helper()
+	m := vm.New()
+	m.LoadProgram(assemble(t, src))
+	c := NewClock(m, 1, clock)
+	m.RegisterDevice(1, c)
+	if stop := m.RunSync(context.Background()); stop.Reason != vm.StopWaiting {
+		t.Fatalf("got %v, want waiting", stop.Reason)
+	}
+	m.Run()
+	return m, c
+}
+
+func ticksAt(m *vm.VM) (count, status byte) {
+	m.Inspect(func(m *vm.VM) {
+		count, status = m.MMIO.Read(0x1000), m.MMIO.Read(0x1001)
+	})
+	return count, status
+}
+
+func TestClockPeriodicTimer(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	m, c := newClockVM(t, fmt.Sprintf(timerProgram, 0x03), clock)
+	defer m.Stop()
+
+	clock.Advance(35 * time.Millisecond)
+	waitFor(t, "3 ticks", func() bool {
+		count, _ := ticksAt(m)
+		return count == 3
+	})
+	if _, status := ticksAt(m); status != 0x04 {
+		t.Fatalf("got status %02X, want timer 2 expired", status)
+	}
+
+	c.Stop()
+	clock.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if count, _ := ticksAt(m); count != 3 {
+		t.Fatalf("got %d ticks after stopping, want 3", count)
+	}
+}
+
+func TestClockOneShotTimer(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	m, c := newClockVM(t, fmt.Sprintf(timerProgram, 0x01), clock)
+	defer m.Stop()
+
+	clock.Advance(9 * time.Millisecond)
+	clock.Advance(100 * time.Millisecond)
+	waitFor(t, "a tick", func() bool {
+		count, _ := ticksAt(m)
+		return count == 1
+	})
+	time.Sleep(10 * time.Millisecond)
+	if count, _ := ticksAt(m); count != 1 {
+		t.Fatalf("got %d ticks, want 1", count)
+	}
+	c.Write(0x0A, 2)
+	if control := c.Read(0x0F); control != 0 {
+		t.Fatalf("got control %02X, want disarmed", control)
+	}
+}
+
+func TestClockLatch(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(1700000000, 0))
+	m := vm.New()
+	m.LoadProgram(assemble(t, `
+push16 0x0311
+push 0x80
+store
+push16 0x1000
+push16 0x0312
+load16
+store16
+push16 0x1002
+push16 0x0314
+load16
+store16
+push16 0x1004
+push16 0x0316
+load16
+store16
+push16 0x1006
+push16 0x0318
+load16
+store16
+halt
+`))
+	m.RegisterDevice(1, NewClock(m, 1, clock))
+	clock.Advance(1234 * time.Millisecond)
+	if stop := m.RunSync(context.Background()); stop.Reason != vm.StopHalted {
+		t.Fatalf("got %v, want halted", stop.Reason)
+	}
+
+	var got []byte
+	m.Inspect(func(m *vm.VM) {
+		got = m.MMIO.ReadData(0x1000, 8)
+	})
+	if ticks := binary.BigEndian.Uint32(got); ticks != 1234 {
+		t.Errorf("got %d ticks, want 1234", ticks)
+	}
+	if wall := binary.BigEndian.Uint32(got[4:]); wall != 1700000001 {
+		t.Errorf("got wall clock %d, want 1700000001", wall)
+	}
+}
@@ -0,0 +1,344 @@
+package devices
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+type InputKind byte
+
+const (
+	InputKeyDown InputKind = iota + 1
+	InputKeyUp
+	InputMouseMove
+	InputButtonDown
+	InputButtonUp
+	InputScroll
+)
+
+// InputEvent is a keyboard or mouse event from the host.
+type InputEvent struct {
+	Kind   InputKind
+	Key    uint16 // keycode of key events
+	Char   byte   // the character a key down types, or 0
+	Mods   byte   // modifier keys held
+	Button byte   // of button events
+	X, Y   int    // pointer position, or how far to scroll
+}
+
+// Modifier bits of InputEvent.Mods.
+const (
+	ModShift = 1 << iota
+	ModCtrl
+	ModAlt
+	ModSuper
+)
+
+// InputSink is a device that takes input events from the host.
+type InputSink interface {
+	SendInput(ev InputEvent)
+}
+
+// WindowID names a surface of a VM.
+type WindowID struct {
+	VM      uint8
+	Surface byte
+}
+
+// Window is a surface placed on the compositor's frame.
+type Window struct {
+	WindowID
+	X, Y          int
+	Width, Height int
+}
+
+func (w Window) Bounds() image.Rectangle {
+	return image.Rect(w.X, w.Y, w.X+w.Width, w.Y+w.Height)
+}
+
+type window struct {
+	Window
+	vm       *vm.VM
+	graphics *Graphics
+}
+
+// cascade is how far apart new windows are placed.
+const cascade = 24
+
+type CompositorOption func(*Compositor)
+
+// WithBackground sets the colour behind the windows. It defaults to black.
+func WithBackground(c color.Color) CompositorOption {
+	return func(comp *Compositor) {
+		comp.background = color.RGBAModel.Convert(c).(color.RGBA)
+	}
+}
+
+// Compositor draws the surfaces of every VM in a System with a Graphics
+// device as windows on one frame, and routes input to the focused window.
+//
+// Windows come and go with their surfaces, which the compositor looks for
+// each time it draws a frame or routes an event. New windows are cascaded
+// from the top left, on top of the others, and are focused if no window is.
+type Compositor struct {
+	sys *System
+
+	mu            sync.Mutex
+	width, height int
+	background    color.RGBA
+	windows       []*window // bottom first
+	focus         *window
+	placed        int
+}
+
+func NewCompositor(sys *System, width, height int, opts ...CompositorOption) *Compositor {
+	c := &Compositor{
+		sys:        sys,
+		width:      width,
+		height:     height,
+		background: color.RGBA{A: 0xFF},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// graphicsOf returns the first graphics device of m, or nil.
+func graphicsOf(m *vm.VM) *Graphics {
+	for slot := range 0x10 {
+		if g, ok := m.Device(slot).(*Graphics); ok {
+			return g
+		}
+	}
+	return nil
+}
+
+// refresh brings the windows up to date with the surfaces of running VMs.
+func (c *Compositor) refresh() {
+	type surface struct {
+		m    *vm.VM
+		g    *Graphics
+		size image.Point
+	}
+	live := map[WindowID]surface{}
+	for _, p := range c.sys.List() {
+		if p.State.Ended() {
+			continue
+		}
+		m, err := c.sys.GetVM(p.ID)
+		if err != nil {
+			continue
+		}
+		g := graphicsOf(m)
+		if g == nil {
+			continue
+		}
+		for id, size := range g.sizes() {
+			live[WindowID{p.ID, id}] = surface{m, g, size}
+		}
+	}
+
+	kept := c.windows[:0]
+	for _, w := range c.windows {
+		// a VM ID can be reused, so check it's the same machine
+		if s, ok := live[w.WindowID]; ok && s.m == w.vm {
+			w.Width, w.Height = s.size.X, s.size.Y
+			kept = append(kept, w)
+			delete(live, w.WindowID)
+		} else if w == c.focus {
+			c.focus = nil
+		}
+	}
+	clear(c.windows[len(kept):])
+	c.windows = kept
+
+	added := make([]WindowID, 0, len(live))
+	for id := range live {
+		added = append(added, id)
+	}
+	sort.Slice(added, func(i, j int) bool {
+		if added[i].VM != added[j].VM {
+			return added[i].VM < added[j].VM
+		}
+		return added[i].Surface < added[j].Surface
+	})
+	for _, id := range added {
+		s := live[id]
+		offset := (c.placed % 8) * cascade
+		c.placed++
+		c.windows = append(c.windows, &window{
+			Window:   Window{WindowID: id, X: offset, Y: offset, Width: s.size.X, Height: s.size.Y},
+			vm:       s.m,
+			graphics: s.g,
+		})
+	}
+	if c.focus == nil && len(c.windows) > 0 {
+		c.focus = c.windows[len(c.windows)-1]
+	}
+}
+
+func (c *Compositor) find(id WindowID) (int, error) {
+	c.refresh()
+	for i, w := range c.windows {
+		if w.WindowID == id {
+			return i, nil
+		}
+	}
+	return 0, errors.New("window not found")
+}
+
+// Windows returns the windows from the bottom up.
+func (c *Compositor) Windows() []Window {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refresh()
+	out := make([]Window, len(c.windows))
+	for i, w := range c.windows {
+		out[i] = w.Window
+	}
+	return out
+}
+
+// Move places a window's top left corner at x, y. Windows may hang off the
+// frame.
+func (c *Compositor) Move(id WindowID, x, y int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, err := c.find(id)
+	if err != nil {
+		return err
+	}
+	c.windows[i].X, c.windows[i].Y = x, y
+	return nil
+}
+
+// Raise puts a window on top of the others.
+func (c *Compositor) Raise(id WindowID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, err := c.find(id)
+	if err != nil {
+		return err
+	}
+	c.raise(i)
+	return nil
+}
+
+func (c *Compositor) raise(i int) {
+	w := c.windows[i]
+	c.windows = append(append(c.windows[:i], c.windows[i+1:]...), w)
+}
+
+// Lower puts a window below the others.
+func (c *Compositor) Lower(id WindowID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, err := c.find(id)
+	if err != nil {
+		return err
+	}
+	w := c.windows[i]
+	copy(c.windows[1:i+1], c.windows[:i])
+	c.windows[0] = w
+	return nil
+}
+
+// Focus makes a window the one input goes to.
+func (c *Compositor) Focus(id WindowID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, err := c.find(id)
+	if err != nil {
+		return err
+	}
+	c.focus = c.windows[i]
+	return nil
+}
+
+// Focused returns the focused window, if there are any windows.
+func (c *Compositor) Focused() (Window, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refresh()
+	if c.focus == nil {
+		return Window{}, false
+	}
+	return c.focus.Window, true
+}
+
+// WindowAt returns the topmost window at x, y on the frame.
+func (c *Compositor) WindowAt(x, y int) (Window, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refresh()
+	if i := c.windowAt(x, y); i >= 0 {
+		return c.windows[i].Window, true
+	}
+	return Window{}, false
+}
+
+func (c *Compositor) windowAt(x, y int) int {
+	for i := len(c.windows) - 1; i >= 0; i-- {
+		if (image.Point{x, y}).In(c.windows[i].Bounds()) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Frame draws the windows over the background, from the bottom up.
+func (c *Compositor) Frame() *image.RGBA {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refresh()
+	frame := image.NewRGBA(image.Rect(0, 0, c.width, c.height))
+	draw.Draw(frame, frame.Rect, image.NewUniform(c.background), image.Point{}, draw.Src)
+	for _, w := range c.windows {
+		w.graphics.composite(frame, w.Surface, image.Pt(w.X, w.Y))
+	}
+	return frame
+}
+
+// WritePNG encodes a frame as a PNG.
+func (c *Compositor) WritePNG(w io.Writer) error {
+	return png.Encode(w, c.Frame())
+}
+
+// SendInput routes an event to every InputSink device of the focused
+// window's VM. Pressing a mouse button first focuses and raises the window
+// under the pointer, if there is one. Pointer positions are made relative to
+// the focused window.
+func (c *Compositor) SendInput(ev InputEvent) {
+	c.mu.Lock()
+	c.refresh()
+	if ev.Kind == InputButtonDown {
+		if i := c.windowAt(ev.X, ev.Y); i >= 0 {
+			c.focus = c.windows[i]
+			c.raise(i)
+		}
+	}
+	if c.focus == nil {
+		c.mu.Unlock()
+		return
+	}
+	m, x, y := c.focus.vm, c.focus.X, c.focus.Y
+	c.mu.Unlock()
+	if ev.Kind != InputKeyDown && ev.Kind != InputKeyUp && ev.Kind != InputScroll {
+		ev.X -= x
+		ev.Y -= y
+	}
+	for slot := range 0x10 {
+		if sink, ok := m.Device(slot).(InputSink); ok {
+			sink.SendInput(ev)
+		}
+	}
+}
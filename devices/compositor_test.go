@@ -0,0 +1,133 @@
+package devices
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/png"
+	"sync"
+	"testing"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+// drawProgram runs the command buffer at 0x2000 on the graphics device in
+// slot 4, then waits
+const drawProgram = `
+push16 0x0341
+push16 0x2000
+store16
+push16 0x0343
+push16 %d
+store16
+push16 0x0345
+push 1
+store
+wait:
+yield
+push16 wait
+push 1
+jnz
+`
+
+type sinkRecorder struct {
+	mu     sync.Mutex
+	events []InputEvent
+}
+
+func (s *sinkRecorder) Write(addr uint16, data byte) {}
+func (s *sinkRecorder) Read(addr uint16) byte        { return 0 }
+
+func (s *sinkRecorder) SendInput(ev InputEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, ev)
+}
+
+func (s *sinkRecorder) Events() []InputEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]InputEvent(nil), s.events...)
+}
+
+func spawnDrawing(t *testing.T, sys *System, d drawList) (uint8, *sinkRecorder) {
+	t.Helper()
+	sink := &sinkRecorder{}
+	id, err := sys.Spawn(assemble(t, fmt.Sprintf(drawProgram, len(d))), func(m *vm.VM) {
+		m.MMIO.WriteData(0x2000, d)
+		m.RegisterDevice(4, NewGraphics(m))
+		m.RegisterDevice(6, sink)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, sink
+}
+
+func TestCompositor(t *testing.T) {
+	sys := NewSystem()
+	defer sys.Close()
+	a, sinkA := spawnDrawing(t, sys, drawList{}.
+		cmd(DrawCreate, 1, 16, 12).
+		cmd(DrawClear, 1).colour(0xC0, 0x20, 0x20, 0xFF))
+	b, sinkB := spawnDrawing(t, sys, drawList{}.
+		cmd(DrawCreate, 0, 16, 12).
+		cmd(DrawClear, 0).colour(0x20, 0xC0, 0x20, 0x80).
+		cmd(DrawRect, 0, 2, 2, 4, 4).colour(0xFF, 0xFF, 0xFF, 0xFF))
+
+	c := NewCompositor(sys, 40, 30, WithBackground(color.Gray{0x30}))
+	waitFor(t, "windows", func() bool { return len(c.Windows()) == 2 })
+	winA, winB := WindowID{a, 1}, WindowID{b, 0}
+	if w := c.Windows(); w[0].WindowID != winA || w[1] != (Window{winB, cascade, cascade, 16, 12}) {
+		t.Fatalf("got windows %+v", w)
+	}
+	if w, _ := c.Focused(); w.WindowID != winB {
+		t.Fatalf("got focus on %+v, want the top window", w)
+	}
+
+	if err := c.Move(winB, 8, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Move(winA, -4, 0); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "compositor.png", c.Frame())
+
+	// clicking the part of A not under B focuses and raises it
+	c.SendInput(InputEvent{Kind: InputButtonDown, Button: 1, X: 2, Y: 2})
+	c.SendInput(InputEvent{Kind: InputKeyDown, Key: 'A', Char: 'a', X: 99})
+	if w := c.Windows(); w[1].WindowID != winA {
+		t.Fatalf("got windows %+v, want A on top", w)
+	}
+	want := []InputEvent{
+		{Kind: InputButtonDown, Button: 1, X: 6, Y: 2},
+		{Kind: InputKeyDown, Key: 'A', Char: 'a', X: 99},
+	}
+	if got := sinkA.Events(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got events %+v, want %+v", got, want)
+	}
+	if got := sinkB.Events(); len(got) != 0 {
+		t.Fatalf("got events %+v on the unfocused window", got)
+	}
+	if w, ok := c.WindowAt(10, 6); !ok || w.WindowID != winA {
+		t.Fatalf("got %+v at 10,6", w)
+	}
+
+	if err := sys.Kill(a); err != nil {
+		t.Fatal(err)
+	}
+	sys.Wait(a)
+	if w, _ := c.Focused(); w.WindowID != winB {
+		t.Fatalf("got focus on %+v after A ended", w)
+	}
+	if err := c.Raise(winA); err == nil {
+		t.Fatal("expected an error raising an ended VM's window")
+	}
+	var buf bytes.Buffer
+	if err := c.WritePNG(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := png.Decode(&buf); err != nil || img.Bounds().Dx() != 40 {
+		t.Fatalf("got %v, %v", img, err)
+	}
+}
@@ -0,0 +1,144 @@
+package devices
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"sync"
+	"time"
+)
+
+// Display is where a Frontend shows its frames and takes its input from: a
+// window on the host, or a HeadlessDisplay.
+type Display interface {
+	// Present shows a frame.
+	Present(frame *image.RGBA) error
+	// Poll returns the input events since the last poll, and false once the
+	// display has been closed.
+	Poll() ([]InputEvent, bool)
+	Close() error
+}
+
+// HeadlessDisplay is a Display without a screen, for tests and CI. It keeps
+// the last frame presented and returns events injected into it.
+type HeadlessDisplay struct {
+	mu     sync.Mutex
+	frame  *image.RGBA
+	frames int
+	events []InputEvent
+	closed bool
+}
+
+func NewHeadlessDisplay() *HeadlessDisplay {
+	return &HeadlessDisplay{}
+}
+
+func (d *HeadlessDisplay) Present(frame *image.RGBA) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return errors.New("display closed")
+	}
+	d.frame = frame
+	d.frames++
+	return nil
+}
+
+func (d *HeadlessDisplay) Poll() ([]InputEvent, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	events := d.events
+	d.events = nil
+	return events, !d.closed
+}
+
+func (d *HeadlessDisplay) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	return nil
+}
+
+// Inject queues events for the next poll.
+func (d *HeadlessDisplay) Inject(events ...InputEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events = append(d.events, events...)
+}
+
+// Frame returns the last frame presented and how many have been, or nil
+// before the first.
+func (d *HeadlessDisplay) Frame() (*image.RGBA, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.frame, d.frames
+}
+
+// WritePNG encodes the last frame presented as a PNG.
+func (d *HeadlessDisplay) WritePNG(w io.Writer) error {
+	frame, _ := d.Frame()
+	if frame == nil {
+		return errors.New("no frame presented")
+	}
+	return png.Encode(w, frame)
+}
+
+// Frontend connects a Compositor, and optionally a text Screen, to a
+// Display. Each frame shows the compositor's frame with the screen below it,
+// and sends the display's input events to the compositor. Pointer events
+// outside the compositor's frame, such as over the screen, are dropped.
+type Frontend struct {
+	Display    Display
+	Compositor *Compositor
+	Screen     *Screen
+}
+
+// Step polls the display for events, routes them and presents a frame. It
+// returns false once the display has been closed.
+func (f *Frontend) Step() (bool, error) {
+	events, open := f.Display.Poll()
+	if !open {
+		return false, nil
+	}
+	frame := f.Compositor.Frame()
+	for _, ev := range events {
+		pointer := ev.Kind == InputMouseMove || ev.Kind == InputButtonDown || ev.Kind == InputButtonUp
+		if pointer && !(image.Point{ev.X, ev.Y}).In(frame.Rect) {
+			continue
+		}
+		f.Compositor.SendInput(ev)
+	}
+
+	if f.Screen != nil {
+		var text ImageRenderer
+		f.Screen.Render(&text)
+		img := text.Image()
+		out := image.NewRGBA(image.Rect(0, 0, max(frame.Rect.Dx(), img.Rect.Dx()), frame.Rect.Dy()+img.Rect.Dy()))
+		draw.Draw(out, frame.Rect, frame, image.Point{}, draw.Src)
+		draw.Draw(out, img.Rect.Add(image.Pt(0, frame.Rect.Dy())), img, image.Point{}, draw.Src)
+		frame = out
+	}
+	return true, f.Display.Present(frame)
+}
+
+// Run steps every interval until the display is closed or ctx is done, then
+// closes the display.
+func (f *Frontend) Run(ctx context.Context, interval time.Duration) error {
+	defer f.Display.Close()
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		open, err := f.Step()
+		if err != nil || !open {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick.C:
+		}
+	}
+}
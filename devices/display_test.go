@@ -0,0 +1,69 @@
+package devices
+
+import (
+	"fmt"
+	"image/color"
+	"testing"
+)
+
+func TestFrontendHeadless(t *testing.T) {
+	sys := NewSystem()
+	defer sys.Close()
+	_, sink := spawnDrawing(t, sys, drawList{}.
+		cmd(DrawCreate, 0, 8, 8).
+		cmd(DrawClear, 0).colour(0xFF, 0x00, 0x00, 0xFF))
+	screen := NewScreen(nil, 4, 2)
+	screen.Write(0x05, 0x1E)
+	screen.Write(0x06, 'A')
+
+	display := NewHeadlessDisplay()
+	f := &Frontend{
+		Display:    display,
+		Compositor: NewCompositor(sys, 40, 20),
+		Screen:     screen,
+	}
+	waitFor(t, "a window", func() bool { return len(f.Compositor.Windows()) == 1 })
+
+	display.Inject(
+		InputEvent{Kind: InputMouseMove, X: 3, Y: 4},
+		InputEvent{Kind: InputButtonDown, Button: 1, X: 3, Y: 25}, // over the screen
+		InputEvent{Kind: InputKeyDown, Key: 'Q', Char: 'q'},
+		InputEvent{Kind: InputScroll, Y: -1},
+	)
+	if open, err := f.Step(); !open || err != nil {
+		t.Fatalf("got %v, %v", open, err)
+	}
+	want := []InputEvent{
+		{Kind: InputMouseMove, X: 3, Y: 4},
+		{Kind: InputKeyDown, Key: 'Q', Char: 'q'},
+		{Kind: InputScroll, Y: -1},
+	}
+	if got := sink.Events(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got events %+v, want %+v", got, want)
+	}
+
+	frame, n := display.Frame()
+	if n != 1 || frame.Rect.Dx() != 40 || frame.Rect.Dy() != 36 {
+		t.Fatalf("got frame %d of %v, want 40x36", n, frame.Rect)
+	}
+	for _, c := range []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{0, 0, color.RGBA{0xFF, 0x00, 0x00, 0xFF}},   // the window
+		{10, 10, color.RGBA{0x00, 0x00, 0x00, 0xFF}}, // the background
+		{0, 20, color.RGBA{0x00, 0x00, 0xAA, 0xFF}},  // behind the A
+		{3, 21, color.RGBA{0xFF, 0xFF, 0x55, 0xFF}},  // the A
+		{8, 27, color.RGBA{0xAA, 0xAA, 0xAA, 0xFF}},  // the cursor
+		{39, 35, color.RGBA{0x00, 0x00, 0x00, 0x00}}, // past the screen
+	} {
+		if got := frame.RGBAAt(c.x, c.y); got != c.want {
+			t.Errorf("pixel %d,%d: got %v, want %v", c.x, c.y, got, c.want)
+		}
+	}
+
+	display.Close()
+	if open, _ := f.Step(); open {
+		t.Fatal("step after close")
+	}
+}
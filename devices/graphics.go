@@ -1,13 +1,472 @@
 package devices
 
-type Graphics struct {
-	surfaces map[byte]Surface
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+const GraphicsDeviceType = 0x04
+
+// GraphicsMaxSize is the largest width or height of a surface.
+const GraphicsMaxSize = 1024
+
+/**
+Graphics Device
+
+Draws into RGBA surfaces by running a buffer of draw commands from VM memory.
+Commands run in order until one fails, when status says why and error_offset
+where; the commands after it are skipped.
+
+Reg  Addr   Name              R/W   Description
+---  ----   ----              ---   -----------
+0    0x00   device_type       R     0x04 = graphics
+1    0x01   cmd_addr_high     W
+2    0x02   cmd_addr_low      W
+3    0x03   cmd_length_high   W
+4    0x04   cmd_length_low    W
+5    0x05   execute           W     run the command buffer
+6    0x06   status            R     0 ok, 1 unknown command, 2 truncated command, 3 no such surface, 4 bad size
+7    0x07   error_offset_high R     offset of the failed command in the buffer
+8    0x08   error_offset_low  R
+9    0x09   surfaces          R     number of surfaces
+
+Draw commands start with an opcode and a surface ID. Numbers are big endian;
+coordinates are signed 16 bit and may fall outside the surface, which clips
+them. Colours are red, green, blue and alpha bytes and are blended over the
+surface, except by clear.
+
+Op    Command   Arguments after the surface
+--    -------   ---------------------------
+0x01  create    width16 height16                 create or replace a transparent surface
+0x02  destroy
+0x03  clear     colour                           fill the surface
+0x04  rect      x y width16 height16 colour      filled rectangle
+0x05  line      x0 y0 x1 y1 colour
+0x06  pixel     x y colour
+0x07  blit      x y width16 height16 addr16      RGBA sprite read from VM memory
+0x08  text      x y colour length chars...       8x8 font, \n starts a new line
+**/
+
+const (
+	DrawCreate  = 0x01
+	DrawDestroy = 0x02
+	DrawClear   = 0x03
+	DrawRect    = 0x04
+	DrawLine    = 0x05
+	DrawPixel   = 0x06
+	DrawBlit    = 0x07
+	DrawText    = 0x08
+)
+
+const (
+	DrawErrCommand   = 0x01
+	DrawErrTruncated = 0x02
+	DrawErrSurface   = 0x03
+	DrawErrSize      = 0x04
+)
+
+// DrawCommand is a parsed draw command. Which fields are used depends on Op.
+type DrawCommand struct {
+	Op      byte
+	Surface byte
+	X, Y    int // position, or the start of a line
+	X1, Y1  int // the end of a line
+	W, H    int
+	Colour  color.NRGBA
+	Addr    uint16 // of a blit's sprite
+	Text    []byte
+
+	Offset int // in the command buffer
+}
+
+// DrawError is a command that could not be parsed or run.
+type DrawError struct {
+	Code   byte
+	Offset int
+}
+
+func (e *DrawError) Error() string {
+	msg := map[byte]string{
+		DrawErrCommand:   "unknown command",
+		DrawErrTruncated: "truncated command",
+		DrawErrSurface:   "no such surface",
+		DrawErrSize:      "bad size",
+	}[e.Code]
+	return fmt.Sprintf("draw command at %d: %s", e.Offset, msg)
+}
+
+// argument lengths after the opcode and surface, text adding its characters
+var drawArgs = map[byte]int{
+	DrawCreate:  4,
+	DrawDestroy: 0,
+	DrawClear:   4,
+	DrawRect:    12,
+	DrawLine:    12,
+	DrawPixel:   8,
+	DrawBlit:    10,
+	DrawText:    9,
+}
+
+// ParseDrawCommands parses a command buffer. It returns the commands before
+// any that can't be parsed, along with a *DrawError.
+func ParseDrawCommands(data []byte) ([]DrawCommand, error) {
+	var cmds []DrawCommand
+	for off := 0; off < len(data); {
+		n, ok := drawArgs[data[off]]
+		if !ok {
+			return cmds, &DrawError{Code: DrawErrCommand, Offset: off}
+		}
+		if off+2+n > len(data) {
+			return cmds, &DrawError{Code: DrawErrTruncated, Offset: off}
+		}
+		args := data[off+2 : off+2+n]
+		cmd := DrawCommand{Op: data[off], Surface: data[off+1], Offset: off}
+		u16 := func(i int) int { return int(args[i])<<8 | int(args[i+1]) }
+		s16 := func(i int) int { return int(int16(u16(i))) }
+		colour := func(i int) color.NRGBA { return color.NRGBA{args[i], args[i+1], args[i+2], args[i+3]} }
+		switch cmd.Op {
+		case DrawCreate:
+			cmd.W, cmd.H = u16(0), u16(2)
+		case DrawClear:
+			cmd.Colour = colour(0)
+		case DrawRect:
+			cmd.X, cmd.Y, cmd.W, cmd.H = s16(0), s16(2), u16(4), u16(6)
+			cmd.Colour = colour(8)
+		case DrawLine:
+			cmd.X, cmd.Y, cmd.X1, cmd.Y1 = s16(0), s16(2), s16(4), s16(6)
+			cmd.Colour = colour(8)
+		case DrawPixel:
+			cmd.X, cmd.Y = s16(0), s16(2)
+			cmd.Colour = colour(4)
+		case DrawBlit:
+			cmd.X, cmd.Y, cmd.W, cmd.H = s16(0), s16(2), u16(4), u16(6)
+			cmd.Addr = uint16(u16(8))
+		case DrawText:
+			cmd.X, cmd.Y = s16(0), s16(2)
+			cmd.Colour = colour(4)
+			length := int(args[8])
+			if off+2+n+length > len(data) {
+				return cmds, &DrawError{Code: DrawErrTruncated, Offset: off}
+			}
+			cmd.Text = append([]byte(nil), data[off+2+n:off+2+n+length]...)
+			n += length
+		}
+		cmds = append(cmds, cmd)
+		off += 2 + n
+	}
+	return cmds, nil
 }
 
+// Surface is a framebuffer a VM draws on.
 type Surface struct {
-	id byte
+	ID    byte
+	Image *image.RGBA
+}
+
+type Graphics struct {
+	vm *vm.VM
+
+	// mu guards surfaces against hosts reading them
+	mu       sync.Mutex
+	surfaces map[byte]*Surface
+
+	cmdAddr     uint16
+	cmdLength   uint16
+	status      byte
+	errorOffset uint16
+}
+
+func NewGraphics(vm *vm.VM) *Graphics {
+	return &Graphics{
+		vm:       vm,
+		surfaces: map[byte]*Surface{},
+	}
 }
 
-func ParseDrawCommands(data []byte) {
+func (g *Graphics) Write(addr uint16, data byte) {
+	switch addr & 0x000F {
+	case 0x01:
+		g.cmdAddr = (uint16(data) << 8) | (g.cmdAddr & 0x00FF)
+	case 0x02:
+		g.cmdAddr = (uint16(data)) | (g.cmdAddr & 0xFF00)
+	case 0x03:
+		g.cmdLength = (uint16(data) << 8) | (g.cmdLength & 0x00FF)
+	case 0x04:
+		g.cmdLength = (uint16(data)) | (g.cmdLength & 0xFF00)
+	case 0x05:
+		g.status, g.errorOffset = 0, 0
+		var derr *DrawError
+		length := min(int(g.cmdLength), 0x10000-int(g.cmdAddr))
+		if err := g.Execute(g.vm.MMIO.ReadData(g.cmdAddr, length)); errors.As(err, &derr) {
+			g.status, g.errorOffset = derr.Code, uint16(derr.Offset)
+		}
+	}
+}
+
+func (g *Graphics) Read(addr uint16) byte {
+	switch addr & 0x000F {
+	case 0x00:
+		return GraphicsDeviceType
+	case 0x01:
+		return byte(g.cmdAddr >> 8)
+	case 0x02:
+		return byte(g.cmdAddr & 0x00FF)
+	case 0x03:
+		return byte(g.cmdLength >> 8)
+	case 0x04:
+		return byte(g.cmdLength & 0x00FF)
+	case 0x06:
+		return g.status
+	case 0x07:
+		return byte(g.errorOffset >> 8)
+	case 0x08:
+		return byte(g.errorOffset & 0x00FF)
+	case 0x09:
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return byte(min(len(g.surfaces), 255))
+	}
+	return 0
+}
+
+// Execute runs a command buffer. Blits read their sprites from the VM's
+// memory, so Execute must not be called while the VM is running other than
+// by the VM itself.
+func (g *Graphics) Execute(data []byte) error {
+	cmds, parseErr := ParseDrawCommands(data)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, cmd := range cmds {
+		if err := g.draw(cmd); err != nil {
+			return err
+		}
+	}
+	return parseErr
+}
+
+func (g *Graphics) draw(cmd DrawCommand) error {
+	switch cmd.Op {
+	case DrawCreate:
+		if cmd.W < 1 || cmd.H < 1 || cmd.W > GraphicsMaxSize || cmd.H > GraphicsMaxSize {
+			return &DrawError{Code: DrawErrSize, Offset: cmd.Offset}
+		}
+		g.surfaces[cmd.Surface] = &Surface{
+			ID:    cmd.Surface,
+			Image: image.NewRGBA(image.Rect(0, 0, cmd.W, cmd.H)),
+		}
+		return nil
+	case DrawDestroy:
+		if _, ok := g.surfaces[cmd.Surface]; !ok {
+			return &DrawError{Code: DrawErrSurface, Offset: cmd.Offset}
+		}
+		delete(g.surfaces, cmd.Surface)
+		return nil
+	}
+
+	s, ok := g.surfaces[cmd.Surface]
+	if !ok {
+		return &DrawError{Code: DrawErrSurface, Offset: cmd.Offset}
+	}
+	var sprite []byte
+	if cmd.Op == DrawBlit {
+		if int(cmd.Addr)+cmd.W*cmd.H*4 > 0x10000 {
+			return &DrawError{Code: DrawErrSize, Offset: cmd.Offset}
+		}
+		sprite = g.vm.MMIO.ReadData(cmd.Addr, cmd.W*cmd.H*4)
+	}
+	Render(s.Image, cmd, sprite)
+	return nil
+}
+
+// Render is the software renderer: it draws cmd onto dst. Blits take their
+// pixels from sprite. Create and destroy do nothing.
+func Render(dst *image.RGBA, cmd DrawCommand, sprite []byte) {
+	src := image.NewUniform(cmd.Colour)
+	switch cmd.Op {
+	case DrawClear:
+		draw.Draw(dst, dst.Bounds(), src, image.Point{}, draw.Src)
+	case DrawRect:
+		draw.Draw(dst, image.Rect(cmd.X, cmd.Y, cmd.X+cmd.W, cmd.Y+cmd.H), src, image.Point{}, draw.Over)
+	case DrawLine:
+		line(dst, cmd.X, cmd.Y, cmd.X1, cmd.Y1, src)
+	case DrawPixel:
+		plot(dst, cmd.X, cmd.Y, src)
+	case DrawBlit:
+		img := &image.NRGBA{Pix: sprite, Stride: cmd.W * 4, Rect: image.Rect(0, 0, cmd.W, cmd.H)}
+		draw.Draw(dst, image.Rect(cmd.X, cmd.Y, cmd.X+cmd.W, cmd.Y+cmd.H), img, image.Point{}, draw.Over)
+	case DrawText:
+		x, y := cmd.X, cmd.Y
+		for _, c := range cmd.Text {
+			if c == '\n' {
+				x, y = cmd.X, y+8
+				continue
+			}
+			for row, bits := range glyph(c) {
+				for col := range 8 {
+					if bits&(1<<col) != 0 {
+						plot(dst, x+col, y+row, src)
+					}
+				}
+			}
+			x += 8
+		}
+	}
+}
+
+func plot(dst *image.RGBA, x, y int, src image.Image) {
+	draw.Draw(dst, image.Rect(x, y, x+1, y+1), src, image.Point{}, draw.Over)
+}
+
+// line draws with Bresenham's algorithm, including both ends.
+func line(dst *image.RGBA, x0, y0, x1, y1 int, src image.Image) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	err := dx + dy
+	for {
+		plot(dst, x0, y0, src)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Surfaces returns the IDs of the surfaces in order.
+func (g *Graphics) Surfaces() []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ids := make([]byte, 0, len(g.surfaces))
+	for id := range g.surfaces {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Surface returns a copy of a surface's image. It may be called from any
+// goroutine.
+func (g *Graphics) Surface(id byte) (*image.RGBA, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.surfaces[id]
+	if !ok {
+		return nil, false
+	}
+	img := image.NewRGBA(s.Image.Rect)
+	copy(img.Pix, s.Image.Pix)
+	return img, true
+}
+
+// WritePNG encodes a surface as a PNG.
+func (g *Graphics) WritePNG(id byte, w io.Writer) error {
+	img, ok := g.Surface(id)
+	if !ok {
+		return errors.New("no such surface")
+	}
+	return png.Encode(w, img)
+}
+
+// composite draws a surface over dst with its top left corner at pt.
+func (g *Graphics) composite(dst *image.RGBA, id byte, pt image.Point) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.surfaces[id]
+	if !ok {
+		return false
+	}
+	draw.Draw(dst, s.Image.Rect.Add(pt), s.Image, image.Point{}, draw.Over)
+	return true
+}
+
+// sizes returns the size of each surface.
+func (g *Graphics) sizes() map[byte]image.Point {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	sizes := make(map[byte]image.Point, len(g.surfaces))
+	for id, s := range g.surfaces {
+		sizes[id] = s.Image.Rect.Size()
+	}
+	return sizes
+}
+
+// SaveState saves the registers and every surface in ID order.
+func (g *Graphics) SaveState() ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	data := []byte{
+		byte(g.cmdAddr >> 8), byte(g.cmdAddr),
+		byte(g.cmdLength >> 8), byte(g.cmdLength),
+		g.status, byte(g.errorOffset >> 8), byte(g.errorOffset),
+	}
+	for id := range 256 {
+		s, ok := g.surfaces[byte(id)]
+		if !ok {
+			continue
+		}
+		size := s.Image.Rect.Size()
+		data = append(data, s.ID, byte(size.X>>8), byte(size.X), byte(size.Y>>8), byte(size.Y))
+		data = append(data, s.Image.Pix...)
+	}
+	return data, nil
+}
 
+func (g *Graphics) LoadState(data []byte) error {
+	if len(data) < 7 {
+		return errors.New("graphics: bad state length")
+	}
+	surfaces := map[byte]*Surface{}
+	for rest := data[7:]; len(rest) > 0; {
+		if len(rest) < 5 {
+			return errors.New("graphics: bad state length")
+		}
+		w, h := int(rest[1])<<8|int(rest[2]), int(rest[3])<<8|int(rest[4])
+		if w < 1 || h < 1 || w > GraphicsMaxSize || h > GraphicsMaxSize {
+			return errors.New("graphics: bad surface size")
+		}
+		if len(rest) < 5+w*h*4 {
+			return errors.New("graphics: bad state length")
+		}
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		copy(img.Pix, rest[5:])
+		surfaces[rest[0]] = &Surface{ID: rest[0], Image: img}
+		rest = rest[5+w*h*4:]
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cmdAddr = uint16(data[0])<<8 | uint16(data[1])
+	g.cmdLength = uint16(data[2])<<8 | uint16(data[3])
+	g.status = data[4]
+	g.errorOffset = uint16(data[5])<<8 | uint16(data[6])
+	g.surfaces = surfaces
+	return nil
 }
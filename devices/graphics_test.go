@@ -0,0 +1,223 @@
+package devices
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"image"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// drawList builds a command buffer.
+type drawList []byte
+
+func (d drawList) cmd(op, surface byte, args ...int) drawList {
+	d = append(d, op, surface)
+	for _, a := range args {
+		d = append(d, byte(a>>8), byte(a))
+	}
+	return d
+}
+
+func (d drawList) colour(r, g, b, a byte) drawList {
+	return append(d, r, g, b, a)
+}
+
+func checkGolden(t *testing.T, name string, img *image.RGBA) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	golden, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := image.NewRGBA(golden.Bounds())
+	draw.Draw(want, want.Rect, golden, golden.Bounds().Min, draw.Src)
+	if want.Rect != img.Rect {
+		t.Fatalf("got %v image, want %v", img.Rect, want.Rect)
+	}
+	for i := range want.Pix {
+		if want.Pix[i] != img.Pix[i] {
+			x, y := (i%img.Stride)/4, i/img.Stride
+			t.Fatalf("pixel %d,%d differs from %s: got %v, want %v", x, y, path, img.At(x, y), want.At(x, y))
+		}
+	}
+}
+
+func TestGraphicsGolden(t *testing.T) {
+	const (
+		commands = 0x2000
+		sprite   = 0x1000
+	)
+	var d drawList
+	d = d.cmd(DrawCreate, 3, 64, 48)
+	d = d.cmd(DrawClear, 3).colour(0x10, 0x20, 0x40, 0xFF)
+	d = d.cmd(DrawRect, 3, 4, 4, 24, 16).colour(0xE0, 0x40, 0x40, 0xFF)
+	d = d.cmd(DrawRect, 3, 16, 10, 24, 16).colour(0x40, 0xE0, 0x40, 0x80)
+	d = d.cmd(DrawLine, 3, 0, 47, 63, 0).colour(0xFF, 0xFF, 0x00, 0xFF)
+	d = d.cmd(DrawLine, 3, 60, 2, 44, 30).colour(0xFF, 0xFF, 0xFF, 0xFF)
+	d = d.cmd(DrawPixel, 3, 62, 46).colour(0xFF, 0x00, 0xFF, 0xFF)
+	d = d.cmd(DrawPixel, 3, -1, 5).colour(0xFF, 0x00, 0xFF, 0xFF)
+	d = d.cmd(DrawBlit, 3, 44, 36, 4, 4, sprite)
+	d = d.cmd(DrawText, 3, 2, 30).colour(0xFF, 0xFF, 0xFF, 0xFF)
+	d = append(d, 6)
+	d = append(d, "Hi!\nok"...)
+
+	var pixels []byte
+	for y := range 4 {
+		for x := range 4 {
+			pixels = append(pixels, byte(x*64), byte(y*64), 0xFF, byte(0x40+x*0x40))
+		}
+	}
+
+	m := vm.New()
+	m.LoadProgram(assemble(t, `
+push16 0x0341
+push16 0x2000
+store16
+push16 0x0343
+push16 0x00FF
+store16
+push16 0x0345
+push 1
+store
+halt
+`))
+	g := NewGraphics(m)
+	m.RegisterDevice(4, g)
+	m.Reset()
+	m.Inspect(func(m *vm.VM) {
+		m.MMIO.WriteData(commands, d)
+		m.MMIO.WriteData(sprite, pixels)
+		// the buffer runs on past the commands into an unknown one
+		m.MMIO.WriteData(commands+uint16(len(d)), []byte{0xEE})
+	})
+	if stop := m.RunSync(context.Background()); stop.Reason != vm.StopHalted {
+		t.Fatalf("got %v, want halted", stop.Reason)
+	}
+
+	if status, offset := g.Read(0x06), int(g.Read(0x07))<<8|int(g.Read(0x08)); status != DrawErrCommand || offset != len(d) {
+		t.Errorf("got status %d at %d, want an unknown command at %d", status, offset, len(d))
+	}
+	if n := g.Read(0x09); n != 1 {
+		t.Errorf("got %d surfaces", n)
+	}
+	img, ok := g.Surface(3)
+	if !ok {
+		t.Fatal("surface 3 missing")
+	}
+	checkGolden(t, "graphics.png", img)
+}
+
+func TestGraphicsErrors(t *testing.T) {
+	g := NewGraphics(vm.New())
+	var d drawList
+	d = d.cmd(DrawCreate, 1, 8, 8)
+	d = d.cmd(DrawDestroy, 1)
+	d = d.cmd(DrawClear, 1).colour(0, 0, 0, 0)
+	var derr *DrawError
+	if err := g.Execute(d); !errors.As(err, &derr) || derr.Code != DrawErrSurface || derr.Offset != 8 {
+		t.Fatalf("got %v, want no such surface at 8", err)
+	}
+
+	for _, c := range []struct {
+		buf  []byte
+		code byte
+	}{
+		{drawList{}.cmd(DrawCreate, 1, 0, 8), DrawErrSize},
+		{drawList{}.cmd(DrawCreate, 1, GraphicsMaxSize+1, 8), DrawErrSize},
+		{drawList{}.cmd(DrawRect, 1, 0, 0), DrawErrTruncated},
+		{append(drawList{}.cmd(DrawText, 1, 0, 0).colour(0, 0, 0, 0), 3, 'a'), DrawErrTruncated},
+		{[]byte{0x7F, 1}, DrawErrCommand},
+	} {
+		if err := g.Execute(c.buf); !errors.As(err, &derr) || derr.Code != c.code || derr.Offset != 0 {
+			t.Errorf("% X: got %v, want code %d", c.buf, err, c.code)
+		}
+	}
+	if len(g.Surfaces()) != 0 {
+		t.Fatalf("got surfaces %v", g.Surfaces())
+	}
+
+	var buf bytes.Buffer
+	g.Execute(drawList{}.cmd(DrawCreate, 9, 2, 2))
+	if err := g.WritePNG(9, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.WritePNG(8, &buf); err == nil {
+		t.Fatal("expected error writing a missing surface")
+	}
+}
+
+func TestGraphicsState(t *testing.T) {
+	m := vm.New()
+	g := NewGraphics(m)
+	m.RegisterDevice(0, g)
+	d := drawList{}.cmd(DrawCreate, 2, 3, 2)
+	d = d.cmd(DrawPixel, 2, 1, 1).colour(0xFF, 0, 0, 0xFF)
+	d = d.cmd(DrawCreate, 7, 1, 1)
+	d = d.cmd(DrawClear, 5).colour(0, 0, 0, 0)
+	m.Inspect(func(m *vm.VM) {
+		m.MMIO.WriteData(0x2000, d)
+		m.MMIO.Write(0x0301, 0x20)
+		m.MMIO.Write(0x0302, 0x00)
+		m.MMIO.Write(0x0303, byte(len(d)>>8))
+		m.MMIO.Write(0x0304, byte(len(d)))
+		m.MMIO.Write(0x0305, 1)
+	})
+	if g.Read(0x06) != DrawErrSurface {
+		t.Fatalf("got status %d, want no such surface", g.Read(0x06))
+	}
+
+	state, err := g.SaveState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewGraphics(m)
+	if err := restored.LoadState(state); err != nil {
+		t.Fatal(err)
+	}
+	for _, reg := range []uint16{0x01, 0x02, 0x03, 0x04, 0x06, 0x07, 0x08, 0x09} {
+		if got, want := restored.Read(reg), g.Read(reg); got != want {
+			t.Errorf("register %d: got %02X, want %02X", reg, got, want)
+		}
+	}
+	if got := restored.Surfaces(); !bytes.Equal(got, []byte{2, 7}) {
+		t.Fatalf("got surfaces %v", got)
+	}
+	for _, id := range []byte{2, 7} {
+		want, _ := g.Surface(id)
+		got, _ := restored.Surface(id)
+		if got.Rect != want.Rect || !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("surface %d differs", id)
+		}
+	}
+
+	for _, bad := range [][]byte{state[:6], state[:len(state)-1], append(state[:7:7], 1, 0, 0, 0, 1)} {
+		if err := restored.LoadState(bad); err == nil {
+			t.Errorf("% X: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package devices
+
+import (
+	"errors"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+const InputDeviceType = 0x08
+
+// InputBufferSize is the number of event slots in an input device's ring.
+// One is always left free, so it holds up to InputBufferSize-1 unread events.
+const InputBufferSize = 64
+
+/**
+Input Device
+
+Keyboard and mouse events, queued in a ring buffer. The event at head is read
+through the event registers; write head to move past events once they have
+been read. The buffer is empty when head equals tail.
+
+Reg  Addr   Name              R/W   Description
+---  ----   ----              ---   -----------
+0    0x00   device_type       R     0x08 = input
+1    0x01   head              RW    slot of the oldest unread event
+2    0x02   tail              R     slot the next event will be stored in
+3    0x03   control           RW    bit 0 interrupt when events arrive
+4    0x04   status            RW    bit 0 events were dropped as the buffer was full, write 1 to clear
+5    0x05   kind              R     of the event at head: 1 key down, 2 key up, 3 mouse move,
+                                    4 button down, 5 button up, 6 scroll
+6    0x06   mods              R     bit 0 shift, bit 1 ctrl, bit 2 alt, bit 3 super
+7    0x07   code_high         R     keycode, or mouse button from 1 = left, 2 = right, 3 = middle
+8    0x08   code_low          R
+9    0x09   x_high            R     pointer position, or how far to scroll, signed
+10   0x0A   x_low             R
+11   0x0B   callback_high     RW
+12   0x0C   callback_low      RW
+13   0x0D   y_high            R
+14   0x0E   y_low             R
+15   0x0F   char              R     character typed by a key down, 0 if none
+
+Keycodes of printable keys are their ASCII codes, with letters in upper case.
+Other keys have the codes below.
+**/
+
+const InputInterrupt = 0x01
+
+const (
+	KeyEscape       = 256
+	KeyEnter        = 257
+	KeyTab          = 258
+	KeyBackspace    = 259
+	KeyInsert       = 260
+	KeyDelete       = 261
+	KeyRight        = 262
+	KeyLeft         = 263
+	KeyDown         = 264
+	KeyUp           = 265
+	KeyPageUp       = 266
+	KeyPageDown     = 267
+	KeyHome         = 268
+	KeyEnd          = 269
+	KeyF1           = 290 // F2 to F12 follow
+	KeyLeftShift    = 340
+	KeyLeftControl  = 341
+	KeyLeftAlt      = 342
+	KeyLeftSuper    = 343
+	KeyRightShift   = 344
+	KeyRightControl = 345
+	KeyRightAlt     = 346
+	KeyRightSuper   = 347
+)
+
+type InputDevice struct {
+	vm       *vm.VM
+	deviceID int
+
+	events       [InputBufferSize][9]byte
+	head         int
+	tail         int
+	control      byte
+	dropped      bool
+	callbackAddr uint16
+}
+
+// NewInputDevice returns an input device for vm, registered as device
+// deviceNum.
+func NewInputDevice(vm *vm.VM, deviceNum int) *InputDevice {
+	return &InputDevice{
+		vm:       vm,
+		deviceID: deviceNum,
+	}
+}
+
+// encodeEvent lays an event out as the event registers read it.
+func encodeEvent(ev InputEvent) [9]byte {
+	code := ev.Key
+	if ev.Kind == InputButtonDown || ev.Kind == InputButtonUp {
+		code = uint16(ev.Button)
+	}
+	x := uint16(max(min(ev.X, 0x7FFF), -0x8000))
+	y := uint16(max(min(ev.Y, 0x7FFF), -0x8000))
+	return [9]byte{
+		byte(ev.Kind), ev.Mods,
+		byte(code >> 8), byte(code),
+		byte(x >> 8), byte(x),
+		byte(y >> 8), byte(y),
+		ev.Char,
+	}
+}
+
+func (d *InputDevice) Write(addr uint16, data byte) {
+	switch addr & 0x000F {
+	case 0x01:
+		d.head = int(data) % InputBufferSize
+	case 0x03:
+		d.control = data & InputInterrupt
+	case 0x04:
+		if data&0x01 != 0 {
+			d.dropped = false
+		}
+	case 0x0B:
+		d.callbackAddr = (uint16(data) << 8) | (d.callbackAddr & 0x00FF)
+	case 0x0C:
+		d.callbackAddr = (uint16(data)) | (d.callbackAddr & 0xFF00)
+	}
+}
+
+// event registers, in the order of encodeEvent
+var inputEventRegs = map[uint16]int{
+	0x05: 0, 0x06: 1, 0x07: 2, 0x08: 3, 0x09: 4, 0x0A: 5, 0x0D: 6, 0x0E: 7, 0x0F: 8,
+}
+
+func (d *InputDevice) Read(addr uint16) byte {
+	addr &= 0x000F
+	if i, ok := inputEventRegs[addr]; ok {
+		if d.head == d.tail {
+			return 0
+		}
+		return d.events[d.head][i]
+	}
+	switch addr {
+	case 0x00:
+		return InputDeviceType
+	case 0x01:
+		return byte(d.head)
+	case 0x02:
+		return byte(d.tail)
+	case 0x03:
+		return d.control
+	case 0x04:
+		if d.dropped {
+			return 0x01
+		}
+		return 0
+	case 0x0B:
+		return byte(d.callbackAddr >> 8)
+	case 0x0C:
+		return byte(d.callbackAddr & 0x00FF)
+	}
+	return 0
+}
+
+// SendInput queues an event. It may be called from any goroutine; the event
+// is delivered between the VM's instructions, so it is recorded and
+// replayed like any other input.
+func (d *InputDevice) SendInput(ev InputEvent) {
+	d.vm.Deliver(InputDelivery{
+		Slot:  d.deviceID,
+		Event: ev,
+	})
+}
+
+// InputDelivery is the input applied to a VM when an event arrives at the
+// input device in Slot.
+type InputDelivery struct {
+	Slot  int
+	Event InputEvent
+}
+
+func (in InputDelivery) Apply(m *vm.VM) {
+	d, ok := m.Device(in.Slot).(*InputDevice)
+	if !ok {
+		return
+	}
+	next := (d.tail + 1) % InputBufferSize
+	if next == d.head {
+		d.dropped = true
+		return
+	}
+	d.events[d.tail] = encodeEvent(in.Event)
+	d.tail = next
+	if d.control&InputInterrupt != 0 {
+		m.RaiseInterrupt(in.Slot)
+	}
+}
+
+// SaveState saves the registers along with any events not yet read.
+func (d *InputDevice) SaveState() ([]byte, error) {
+	var flags byte
+	if d.dropped {
+		flags = 0x01
+	}
+	data := []byte{
+		byte(d.head), byte(d.tail), d.control, flags,
+		byte(d.callbackAddr >> 8), byte(d.callbackAddr),
+	}
+	for i := d.head; i != d.tail; i = (i + 1) % InputBufferSize {
+		data = append(data, d.events[i][:]...)
+	}
+	return data, nil
+}
+
+func (d *InputDevice) LoadState(data []byte) error {
+	if len(data) < 6 || int(data[0]) >= InputBufferSize || int(data[1]) >= InputBufferSize {
+		return errors.New("input: bad state length")
+	}
+	head, tail := int(data[0]), int(data[1])
+	rest := data[6:]
+	if len(rest) != 9*((tail-head+InputBufferSize)%InputBufferSize) {
+		return errors.New("input: bad state length")
+	}
+	d.head, d.tail = head, tail
+	d.control = data[2]
+	d.dropped = data[3]&0x01 != 0
+	d.callbackAddr = uint16(data[4])<<8 | uint16(data[5])
+	for i := head; i != tail; i = (i + 1) % InputBufferSize {
+		copy(d.events[i][:], rest)
+		rest = rest[9:]
+	}
+	return nil
+}
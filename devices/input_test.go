@@ -0,0 +1,124 @@
+package devices
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+// eventProgram turns on the input device's interrupt and copies the kind,
+// low code byte, low x byte and char of each event to 0x1000 onwards,
+// counting them at 0x10FF
+var eventProgram = `
+push16 0x031B
+push16 on_input
+store16
+push16 0x0313
+push 1
+store
+yield
+
+on_input:
+push16 finished
+push16 0x0311
+load
+push16 0x0312
+load
+eq
+jnz
+` + copyEventRegs(0x0315, 0x0318, 0x031A, 0x031F) + `
+push16 0x10FF
+push16 0x10FF
+load
+inc
+store
+push16 0x0311
+push16 0x0311
+load
+inc
+store
+push16 on_input
+push 1
+jnz
+finished:
+reti
+`
+
+func copyEventRegs(regs ...int) string {
+	var b strings.Builder
+	for i, reg := range regs {
+		fmt.Fprintf(&b, "push 0x10\npush16 0x10FF\nload\npush 4\nmul\npush %d\nadd\npush16 0x%04X\nload\nstore\n", i, reg)
+	}
+	return b.String()
+}
+
+func TestInputEvents(t *testing.T) {
+	m := vm.New()
+	m.LoadProgram(assemble(t, eventProgram))
+	input := NewInputDevice(m, 1)
+	m.RegisterDevice(1, input)
+	if stop := m.RunSync(context.Background()); stop.Reason != vm.StopWaiting {
+		t.Fatalf("got %v, want waiting", stop.Reason)
+	}
+	m.Run()
+	t.Cleanup(m.Stop)
+
+	input.SendInput(InputEvent{Kind: InputKeyDown, Key: 'A', Char: 'A', Mods: ModShift})
+	input.SendInput(InputEvent{Kind: InputButtonDown, Button: 2, X: 300, Y: 4})
+	input.SendInput(InputEvent{Kind: InputScroll, X: -1})
+	input.SendInput(InputEvent{Kind: InputKeyUp, Key: KeyEnter})
+
+	want := []byte{
+		byte(InputKeyDown), 'A', 0, 'A',
+		byte(InputButtonDown), 2, 0x2C, 0,
+		byte(InputScroll), 0, 0xFF, 0,
+		byte(InputKeyUp), KeyEnter & 0xFF, 0, 0,
+	}
+	var got []byte
+	waitFor(t, "events", func() bool {
+		m.Inspect(func(m *vm.VM) {
+			got = m.MMIO.ReadData(0x1000, 4*int(m.MMIO.Read(0x10FF)))
+		})
+		return len(got) == len(want)
+	})
+	if string(got) != string(want) {
+		t.Fatalf("got % X, want % X", got, want)
+	}
+}
+
+func TestInputOverflow(t *testing.T) {
+	m := vm.New()
+	input := NewInputDevice(m, 8)
+	m.RegisterDevice(8, input)
+	for i := range InputBufferSize + 2 {
+		input.SendInput(InputEvent{Kind: InputMouseMove, X: i, Y: -2})
+	}
+
+	var head, tail, status, kind, x, y byte
+	m.Inspect(func(m *vm.VM) {
+		head, tail, status = m.MMIO.Read(0x0381), m.MMIO.Read(0x0382), m.MMIO.Read(0x0384)
+		m.MMIO.Write(0x0381, 0x05)
+		kind, x, y = m.MMIO.Read(0x0385), m.MMIO.Read(0x038A), m.MMIO.Read(0x038E)
+	})
+	if head != 0 || tail != InputBufferSize-1 || status != 0x01 {
+		t.Fatalf("got head %d, tail %d and status %02X, want 0, %d and dropped", head, tail, status, InputBufferSize-1)
+	}
+	if InputKind(kind) != InputMouseMove || x != 5 || y != 0xFE {
+		t.Fatalf("got event %d at %d,%d", kind, x, y)
+	}
+
+	state, _ := input.SaveState()
+	restored := NewInputDevice(m, 8)
+	if err := restored.LoadState(state); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Read(0x01) != 5 || restored.Read(0x02) != InputBufferSize-1 || restored.Read(0x0A) != 5 || restored.Read(0x04) != 0x01 {
+		t.Fatal("restored input device differs")
+	}
+	if err := restored.LoadState(state[:len(state)-1]); err == nil {
+		t.Fatal("expected an error loading a truncated state")
+	}
+}
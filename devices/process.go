@@ -0,0 +1,55 @@
+package devices
+
+import (
+	"fmt"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+type ProcessState int
+
+const (
+	StateStarting ProcessState = iota
+	StateRunning
+	StateWaiting
+	StateHalted
+	StateFaulted
+	StateKilled
+)
+
+func (s ProcessState) String() string {
+	switch s {
+	case StateStarting:
+		return "starting"
+	case StateRunning:
+		return "running"
+	case StateWaiting:
+		return "waiting"
+	case StateHalted:
+		return "halted"
+	case StateFaulted:
+		return "faulted"
+	case StateKilled:
+		return "killed"
+	}
+	return fmt.Sprintf("ProcessState(%d)", int(s))
+}
+
+// Ended reports whether the process has halted, faulted or been killed.
+func (s ProcessState) Ended() bool {
+	return s >= StateHalted
+}
+
+// Process is an entry in the system's process table.
+type Process struct {
+	ID    uint8
+	State ProcessState
+	Exit  vm.State // the machine as it halted, faulted or was killed; Exit.Fault says why a faulted VM faulted
+}
+
+type process struct {
+	Process
+	m      *vm.VM
+	killed bool
+	done   chan struct{}
+}
@@ -0,0 +1,125 @@
+package devices
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+func TestProcessLifecycle(t *testing.T) {
+	sys := NewSystem()
+	defer sys.Close()
+
+	var mu sync.Mutex
+	var events []string
+	record := func(kind string) func(Process) {
+		return func(p Process) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, kind+" "+p.State.String())
+		}
+	}
+	sys.OnSpawn(record("spawn"))
+	sys.OnHalt(record("halt"))
+	sys.OnFault(record("fault"))
+
+	halts, _ := sys.Spawn([]byte{vm.PushInstruction, 0x01, vm.HaltInstruction})
+	p, err := sys.Wait(halts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.State != StateHalted || p.Exit.Cycles != 2 || len(p.Exit.Stack) != 1 {
+		t.Fatalf("got %+v, want halted after 2 cycles", p)
+	}
+
+	faults, _ := sys.Spawn([]byte{0x30})
+	p, _ = sys.Wait(faults)
+	if p.State != StateFaulted || p.Exit.Fault.Cause != vm.FaultInvalidOpcode {
+		t.Fatalf("got %+v, want an invalid opcode fault", p)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"spawn running", "halt halted", "spawn running", "fault faulted"}
+	if len(events) != len(want) {
+		t.Fatalf("got events %q, want %q", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("got events %q, want %q", events, want)
+		}
+	}
+}
+
+func TestProcessKill(t *testing.T) {
+	sys := NewSystem()
+	defer sys.Close()
+
+	waiting, _ := sys.Spawn([]byte{vm.YieldInstruction})
+	looping, _ := sys.Spawn([]byte{vm.Push16Instruction, 0x04, 0x00, vm.PushInstruction, 0x01, vm.JnzInstruction})
+	waitFor(t, "vm to wait", func() bool {
+		return sys.List()[0].State == StateWaiting
+	})
+	if list := sys.List(); len(list) != 2 || list[1].ID != looping || list[1].State != StateRunning {
+		t.Fatalf("got %+v", list)
+	}
+	if _, err := sys.GetVM(looping); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []uint8{waiting, looping} {
+		if err := sys.Kill(id); err != nil {
+			t.Fatal(err)
+		}
+		if p, _ := sys.Wait(id); p.State != StateKilled {
+			t.Fatalf("vm %d is %v, want killed", id, p.State)
+		}
+		if err := sys.Kill(id); err == nil {
+			t.Fatalf("killing vm %d twice succeeded", id)
+		}
+	}
+
+	// killed IDs are handed out again
+	id, _ := sys.Spawn([]byte{vm.HaltInstruction})
+	if id != waiting {
+		t.Fatalf("got id %d, want %d reused", id, waiting)
+	}
+	if _, err := sys.Wait(99); err == nil {
+		t.Fatal("expected error waiting for a missing vm")
+	}
+}
+
+func TestProcessStopsClocks(t *testing.T) {
+	sys := NewSystem()
+	defer sys.Close()
+	withClock := func(m *vm.VM) {
+		m.RegisterDevice(1, NewClock(m, 1, RealTime{}))
+	}
+	armed := func(m *vm.VM) bool {
+		c := m.Device(1).(*Clock)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.timers[2].armed
+	}
+
+	periodic := fmt.Sprintf(timerProgram, 0x03)
+	halts, _ := sys.Spawn(assemble(t, strings.Replace(periodic, "yield", "halt", 1)), withClock)
+	waits, _ := sys.Spawn(assemble(t, periodic), withClock)
+	m, _ := sys.GetVM(waits)
+	waitFor(t, "a tick", func() bool {
+		count, _ := ticksAt(m)
+		return count > 0
+	})
+	if err := sys.Kill(waits); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint8{halts, waits} {
+		p, _ := sys.Wait(id)
+		if m, _ := sys.GetVM(id); armed(m) {
+			t.Errorf("the clock of a %v vm is still running", p.State)
+		}
+	}
+}
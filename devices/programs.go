@@ -0,0 +1,24 @@
+package devices
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/alisdairrankine/frienvironment/assembler"
+)
+
+// ProgramLoader resolves a program name to its bytecode.
+type ProgramLoader func(name string) ([]byte, error)
+
+// LoadProgramFile reads the program at path name. Assembly sources, ending in
+// .ca, are assembled; anything else is loaded as bytecode.
+func LoadProgramFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(name) == ".ca" {
+		return assembler.AssembleSource(name, string(data))
+	}
+	return data, nil
+}
@@ -0,0 +1,164 @@
+package devices
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+func init() {
+	gob.Register(vm.InterruptInput{})
+	gob.Register(vm.LineInput{})
+	gob.Register(SwitchDelivery{})
+	gob.Register(SystemCompletion{})
+	gob.Register(ClockLatch{})
+	gob.Register(ClockTick{})
+	gob.Register(TerminalInput{})
+	gob.Register(InputDelivery{})
+}
+
+var ErrDiverged = errors.New("replay diverged from recording")
+
+// Event is an input applied to a VM, tagged with the number of instructions
+// the VM had executed when it was applied.
+type Event struct {
+	Cycle uint64
+	Input vm.Input
+}
+
+// VMRecording is everything needed to replay one VM.
+type VMRecording struct {
+	ID      uint8
+	Program []byte
+	Events  []Event
+	Cycles  uint64 // instructions executed when the recording was taken
+}
+
+// Recording holds the inputs of every VM in a System, in spawn order.
+type Recording struct {
+	VMs []VMRecording
+}
+
+// Write encodes the recording with encoding/gob. Inputs from devices
+// outside this package must be registered with gob.Register.
+func (r *Recording) Write(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(r)
+}
+
+func ReadRecording(r io.Reader) (*Recording, error) {
+	var rec Recording
+	if err := gob.NewDecoder(r).Decode(&rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (r *Recording) vm(id uint8) *VMRecording {
+	for i := range r.VMs {
+		if r.VMs[i].ID == id {
+			return &r.VMs[i]
+		}
+	}
+	return nil
+}
+
+// Recorder logs the inputs delivered to each VM spawned by a System.
+type Recorder struct {
+	mu  sync.Mutex
+	vms []*recordedVM
+}
+
+type recordedVM struct {
+	m   *vm.VM
+	rec VMRecording
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) attach(id uint8, program []byte, m *vm.VM) {
+	v := &recordedVM{
+		m:   m,
+		rec: VMRecording{ID: id, Program: append([]byte(nil), program...)},
+	}
+	r.mu.Lock()
+	r.vms = append(r.vms, v)
+	r.mu.Unlock()
+	m.OnInput(func(cycle uint64, in vm.Input) {
+		r.mu.Lock()
+		v.rec.Events = append(v.rec.Events, Event{Cycle: cycle, Input: in})
+		r.mu.Unlock()
+	})
+}
+
+// Recording returns what has been recorded so far. Each VM's recording ends
+// at the cycle it had reached when Recording was called, so take it once
+// the VMs have halted or are waiting for an exact replay.
+func (r *Recorder) Recording() *Recording {
+	r.mu.Lock()
+	vms := append([]*recordedVM(nil), r.vms...)
+	r.mu.Unlock()
+
+	out := &Recording{}
+	for _, v := range vms {
+		cycles := v.m.State().Cycles
+		r.mu.Lock()
+		rec := v.rec
+		rec.Events = nil
+		for _, ev := range v.rec.Events {
+			if ev.Cycle <= cycles {
+				rec.Events = append(rec.Events, ev)
+			}
+		}
+		r.mu.Unlock()
+		rec.Cycles = cycles
+		out.VMs = append(out.VMs, rec)
+	}
+	return out
+}
+
+// replayVM drives m through the recorded inputs, applying each one once m
+// has executed as many instructions as it had when the input was recorded.
+// It returns how the VM stopped last.
+func replayVM(m *vm.VM, rec *VMRecording) (vm.Stop, error) {
+	var last vm.Stop
+	for _, ev := range rec.Events {
+		if err := runTo(m, ev.Cycle, &last); err != nil {
+			return last, fmt.Errorf("vm %d: %w", rec.ID, err)
+		}
+		m.Inspect(ev.Input.Apply)
+	}
+	if err := runTo(m, rec.Cycles, &last); err != nil {
+		return last, fmt.Errorf("vm %d: %w", rec.ID, err)
+	}
+	return last, nil
+}
+
+func runTo(m *vm.VM, cycle uint64, last *vm.Stop) error {
+	for {
+		cycles := m.State().Cycles
+		if cycles == cycle {
+			return nil
+		}
+		if cycles > cycle {
+			return fmt.Errorf("%w: at cycle %d, past cycle %d", ErrDiverged, cycles, cycle)
+		}
+		stop := m.RunFor(cycle - cycles)
+		*last = stop
+		switch stop.Reason {
+		case vm.StopBudget:
+			return nil
+		case vm.StopBreakpoint, vm.StopWatchpoint:
+			continue
+		}
+		if stop.State.Cycles != cycle {
+			return fmt.Errorf("%w: %s at cycle %d, recording continues to cycle %d", ErrDiverged, stop.Reason, stop.State.Cycles, cycle)
+		}
+		return nil
+	}
+}
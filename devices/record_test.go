@@ -0,0 +1,148 @@
+package devices
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/alisdairrankine/frienvironment/assembler"
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+// counts at 0x2000 until a message arrives, so the memory it halts with
+// depends on when the sender got to run
+const countingReceiver = `
+push16 0x0309
+push16 0x1000
+store16
+push16 0x030B
+push16 on_message
+store16
+loop:
+push16 0x2000
+push16 0x2000
+load
+inc
+store
+push16 loop
+push 1
+jnz
+on_message:
+halt
+`
+
+const pingSender = `
+push16 0x1000
+push16 'pi'
+store16
+push16 0x1002
+push16 'ng'
+store16
+push16 0x0307
+push16 0x1000
+store16
+push16 0x0306
+push 4
+store
+push16 0x0302
+push 0
+store
+push16 0x030D
+push 0
+store
+halt
+`
+
+// runPing runs the receiver and sender on sys until both stop and returns
+// their memory.
+func runPing(t *testing.T, sys *System, replay bool) [][]byte {
+	t.Helper()
+	sw := NewSwitch()
+	var stopped sync.WaitGroup
+	var machines []*vm.VM
+	for _, src := range []string{countingReceiver, pingSender} {
+		program, err := assembler.Assemble(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stopped.Add(1)
+		_, err = sys.Spawn(program, func(m *vm.VM) {
+			sw.Attach(0, m)
+			m.OnStop(func(vm.Stop) { stopped.Done() })
+			machines = append(machines, m)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if replay {
+		if err := sys.WaitReplay(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stopped.Wait()
+
+	var memory [][]byte
+	for _, m := range machines {
+		m.Inspect(func(m *vm.VM) {
+			memory = append(memory, append([]byte(nil), m.MMIO.ReadData(0, 0x10000)...))
+		})
+	}
+	return memory
+}
+
+func TestRecordReplay(t *testing.T) {
+	live := NewSystem()
+	defer live.Close()
+	recorder := NewRecorder()
+	live.Record(recorder)
+	want := runPing(t, live, false)
+
+	var buf bytes.Buffer
+	if err := recorder.Recording().Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 10 {
+		rec, err := ReadRecording(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sys := NewSystem()
+		defer sys.Close()
+		sys.Replay(rec)
+		got := runPing(t, sys, true)
+		for id := range want {
+			if !bytes.Equal(got[id], want[id]) {
+				t.Fatalf("replay %d: vm %d memory differs from the recorded run", i, id)
+			}
+		}
+	}
+}
+
+func TestReplayDiverged(t *testing.T) {
+	live := NewSystem()
+	defer live.Close()
+	recorder := NewRecorder()
+	live.Record(recorder)
+	runPing(t, live, false)
+
+	rec := recorder.Recording()
+	rec.VMs[1].Cycles += 10
+
+	sys := NewSystem()
+	defer sys.Close()
+	sys.Replay(rec)
+	program, _ := assembler.Assemble(countingReceiver)
+	sys.Spawn(program, func(m *vm.VM) { NewSwitch().Attach(0, m) })
+	program, _ = assembler.Assemble(pingSender)
+	sys.Spawn(program)
+	if err := sys.WaitReplay(); !errors.Is(err, ErrDiverged) {
+		t.Fatalf("got %v, want ErrDiverged", err)
+	}
+
+	if _, err := sys.Spawn([]byte{vm.HaltInstruction}); err == nil {
+		t.Fatal("expected error spawning a VM that is not in the recording")
+	}
+}
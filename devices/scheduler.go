@@ -0,0 +1,234 @@
+package devices
+
+import (
+	"container/heap"
+	"sync"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+// DefaultTimeSlice is the number of instructions a VM runs before the
+// scheduler gives its worker to the next runnable VM.
+const DefaultTimeSlice = 1000
+
+type taskState int
+
+const (
+	taskReady taskState = iota
+	taskRunning
+	taskParked
+	taskDone
+)
+
+type task struct {
+	id       uint8
+	m        *vm.VM
+	priority int
+	quota    uint64 // total instructions allowed, 0 for no limit
+	used     uint64
+
+	state  taskState
+	woken  bool // an input arrived while running, so don't park
+	parked bool // as last reported
+	seq    uint64
+	index  int
+}
+
+func (t *task) exhausted() bool {
+	return t.quota > 0 && t.used >= t.quota
+}
+
+// scheduler runs VMs cooperatively in time slices on a fixed pool of
+// workers. VMs waiting on YIELD are parked until an input is delivered.
+type scheduler struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	ready  readyQueue
+	tasks  map[uint8]*task
+	slice  uint64
+	seq    uint64
+	closed bool
+
+	// report is called without s.mu held after each time slice that
+	// parks, wakes or ends a task
+	report func(id uint8, state taskState, stop vm.Stop)
+}
+
+func newScheduler(workers int, slice uint64, report func(uint8, taskState, vm.Stop)) *scheduler {
+	s := &scheduler{
+		tasks:  map[uint8]*task{},
+		slice:  slice,
+		report: report,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for range workers {
+		go s.worker()
+	}
+	return s
+}
+
+func (s *scheduler) add(id uint8, m *vm.VM) {
+	t := &task{id: id, m: m}
+	m.OnWake(func() {
+		s.wake(t)
+	})
+	s.mu.Lock()
+	s.tasks[id] = t
+	s.push(t)
+	s.mu.Unlock()
+}
+
+// push queues t to run. The caller holds s.mu.
+func (s *scheduler) push(t *task) {
+	if t.exhausted() {
+		t.state = taskParked
+		t.woken = true
+		return
+	}
+	t.state = taskReady
+	t.seq = s.seq
+	s.seq++
+	heap.Push(&s.ready, t)
+	s.cond.Signal()
+}
+
+func (s *scheduler) wake(t *task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch t.state {
+	case taskParked:
+		s.push(t)
+	case taskRunning:
+		t.woken = true
+	}
+}
+
+// kill lifts the quota of a task that is being stopped and runs it, so that
+// it can finish.
+func (s *scheduler) kill(id uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	if !ok {
+		return
+	}
+	t.quota = 0
+	if t.state == taskParked {
+		s.push(t)
+	}
+}
+
+func (s *scheduler) worker() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for len(s.ready) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			return
+		}
+		t := heap.Pop(&s.ready).(*task)
+		t.state = taskRunning
+		t.woken = false
+		budget := s.slice
+		if t.quota > 0 {
+			budget = min(budget, t.quota-t.used)
+		}
+		s.mu.Unlock()
+
+		stop := t.m.RunFor(budget)
+
+		s.mu.Lock()
+		t.used = stop.State.Cycles
+		was := t.parked
+		switch stop.Reason {
+		case vm.StopHalted, vm.StopFaulted:
+			t.state = taskDone
+			delete(s.tasks, t.id)
+		case vm.StopWaiting:
+			if t.woken {
+				s.push(t)
+			} else {
+				t.state = taskParked
+			}
+		default:
+			s.push(t)
+		}
+		t.parked = t.state == taskParked
+		if t.state == taskDone || t.parked != was {
+			state := t.state
+			s.mu.Unlock()
+			s.report(t.id, state, stop)
+			s.mu.Lock()
+		}
+	}
+}
+
+func (s *scheduler) setPriority(id uint8, priority int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	if !ok {
+		return false
+	}
+	t.priority = priority
+	if t.state == taskReady {
+		heap.Fix(&s.ready, t.index)
+	}
+	return true
+}
+
+func (s *scheduler) setQuota(id uint8, quota uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	if !ok {
+		return false
+	}
+	t.quota = quota
+	if t.state == taskParked && t.woken {
+		s.push(t)
+	}
+	return true
+}
+
+func (s *scheduler) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// readyQueue orders runnable tasks by priority, highest first, then by the
+// order they became runnable.
+type readyQueue []*task
+
+func (q readyQueue) Len() int { return len(q) }
+
+func (q readyQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q readyQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *readyQueue) Push(x any) {
+	t := x.(*task)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+
+func (q *readyQueue) Pop() any {
+	old := *q
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return t
+}
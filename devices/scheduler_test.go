@@ -0,0 +1,164 @@
+package devices
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alisdairrankine/frienvironment/assembler"
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+// waits for a message, then either halts or loops forever
+const wakeProgram = `
+push16 0x030B
+push16 on_message
+store16
+yield
+on_message:
+push16 on_message
+push %d
+jnz
+halt
+`
+
+func assemble(t *testing.T, src string) []byte {
+	t.Helper()
+	program, err := assembler.Assemble(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return program
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *scheduler) state(id uint8) (taskState, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	if !ok {
+		return taskDone, 0
+	}
+	return t.state, t.used
+}
+
+func spawnWaiting(t *testing.T, sys *System, sw *Switch, loop bool) uint8 {
+	t.Helper()
+	flag := 0
+	if loop {
+		flag = 1
+	}
+	id, err := sys.Spawn(assemble(t, fmt.Sprintf(wakeProgram, flag)), func(m *vm.VM) {
+		sw.Attach(0, m)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "vm to park", func() bool {
+		state, _ := sys.sched.state(id)
+		return state == taskParked
+	})
+	return id
+}
+
+func TestSchedulerParksIdleVMs(t *testing.T) {
+	sys := NewSystem(WithWorkers(2))
+	defer sys.Close()
+	sw := NewSwitch()
+
+	var ids []uint8
+	for range 200 {
+		ids = append(ids, spawnWaiting(t, sys, sw, false))
+	}
+	_, before := sys.sched.state(ids[0])
+	time.Sleep(10 * time.Millisecond)
+	if _, after := sys.sched.state(ids[0]); after != before {
+		t.Fatalf("parked vm ran %d instructions", after-before)
+	}
+
+	sw.Send(0xFF, 150, 0, nil)
+	waitFor(t, "woken vm to halt", func() bool {
+		state, _ := sys.sched.state(ids[150])
+		return state == taskDone
+	})
+	if state, _ := sys.sched.state(ids[149]); state != taskParked {
+		t.Fatalf("vm 149 is %v, want parked", state)
+	}
+}
+
+func TestSchedulerTimeSlices(t *testing.T) {
+	sys := NewSystem(WithWorkers(1), WithTimeSlice(100))
+	defer sys.Close()
+	sw := NewSwitch()
+	a := spawnWaiting(t, sys, sw, true)
+	b := spawnWaiting(t, sys, sw, true)
+	sw.Send(0xFF, 0, 0, nil)
+	sw.Send(0xFF, 1, 0, nil)
+
+	// both busy loops make progress on a single worker
+	waitFor(t, "both vms to run", func() bool {
+		_, ca := sys.sched.state(a)
+		_, cb := sys.sched.state(b)
+		return ca > 10000 && cb > 10000
+	})
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	sys := NewSystem(WithWorkers(1), WithTimeSlice(100))
+	defer sys.Close()
+	sw := NewSwitch()
+	low := spawnWaiting(t, sys, sw, true)
+	high := spawnWaiting(t, sys, sw, true)
+	if err := sys.SetPriority(high, 1); err != nil {
+		t.Fatal(err)
+	}
+	sw.Send(0xFF, 1, 0, nil)
+	waitFor(t, "high priority vm to run", func() bool {
+		_, c := sys.sched.state(high)
+		return c > 1000
+	})
+	sw.Send(0xFF, 0, 0, nil)
+
+	_, before := sys.sched.state(low)
+	time.Sleep(10 * time.Millisecond)
+	if _, after := sys.sched.state(low); after != before {
+		t.Fatalf("low priority vm ran %d instructions while a higher one was runnable", after-before)
+	}
+}
+
+func TestSchedulerQuota(t *testing.T) {
+	sys := NewSystem(WithWorkers(2), WithTimeSlice(300))
+	defer sys.Close()
+	sw := NewSwitch()
+	id := spawnWaiting(t, sys, sw, true)
+	_, start := sys.sched.state(id)
+
+	if err := sys.SetQuota(id, start+5000); err != nil {
+		t.Fatal(err)
+	}
+	sw.Send(0xFF, 0, 0, nil)
+	waitFor(t, "quota to run out", func() bool {
+		state, used := sys.sched.state(id)
+		return state == taskParked && used == start+5000
+	})
+
+	sys.SetQuota(id, start+8000)
+	waitFor(t, "raised quota to run out", func() bool {
+		state, used := sys.sched.state(id)
+		return state == taskParked && used == start+8000
+	})
+
+	if err := sys.SetQuota(200, 1); err == nil {
+		t.Fatal("expected error for a missing vm")
+	}
+}
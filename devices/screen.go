@@ -0,0 +1,421 @@
+package devices
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+const ScreenDeviceType = 0x07
+
+const (
+	ScreenWidth  = 80
+	ScreenHeight = 25
+
+	// DefaultAttr is light grey on black.
+	DefaultAttr = 0x07
+)
+
+/**
+Screen Device
+
+A grid of character cells. Each cell has a character and an attribute byte:
+the low nibble is the foreground colour and the high nibble the background,
+from the 16 colour CGA palette.
+
+Reg  Addr   Name              R/W   Description
+---  ----   ----              ---   -----------
+0    0x00   device_type       R     0x07 = screen
+1    0x01   width             R     columns
+2    0x02   height            R     rows
+3    0x03   cursor_x          RW
+4    0x04   cursor_y          RW
+5    0x05   attr              RW    attribute for put, text blits, clear and scroll
+6    0x06   put               W     write a character at the cursor and advance it
+7    0x07   command           W     1 clear, 2 scroll, 3 blit cells, 4 blit text
+8    0x08   src_addr_high     W     source of blits
+9    0x09   src_addr_low      W
+10   0x0A   count             W     lines to scroll, or cells to blit
+11   0x0B   cursor_visible    RW    bit 0 set = cursor shown
+
+Put handles \n, \r and \b, wraps at the end of a line and scrolls at the
+bottom of the screen. Clear blanks the screen and homes the cursor; scroll
+moves the screen up count lines. Blits copy count cells to the screen from the
+cursor onwards, wrapping lines, without moving the cursor: cell blits read a
+character and attribute byte for each cell, text blits read characters only
+and use attr. Blits stop at the end of memory.
+**/
+
+const (
+	ScreenClear     = 0x01
+	ScreenScroll    = 0x02
+	ScreenBlitCells = 0x03
+	ScreenBlitText  = 0x04
+)
+
+type Cell struct {
+	Char byte
+	Attr byte
+}
+
+// Grid is a copy of a screen's contents.
+type Grid struct {
+	Width, Height    int
+	Cells            []Cell // row by row
+	CursorX, CursorY int
+	CursorVisible    bool
+}
+
+func (g Grid) Cell(x, y int) Cell {
+	return g.Cells[y*g.Width+x]
+}
+
+// Line returns the characters of row y, without trailing blanks.
+func (g Grid) Line(y int) string {
+	var b strings.Builder
+	for _, c := range g.Cells[y*g.Width : (y+1)*g.Width] {
+		b.WriteByte(printable(c.Char))
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+// Text returns every line, without trailing blanks or blank lines.
+func (g Grid) Text() string {
+	lines := make([]string, g.Height)
+	for y := range lines {
+		lines[y] = g.Line(y)
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+func printable(c byte) byte {
+	switch {
+	case c == 0:
+		return ' '
+	case c < 0x20 || c >= 0x7F:
+		return '?'
+	}
+	return c
+}
+
+type Screen struct {
+	vm *vm.VM
+
+	// mu guards the screen against hosts taking its grid
+	mu            sync.Mutex
+	width, height int
+	cells         []Cell
+	cursorX       int
+	cursorY       int
+	cursorVisible bool
+	attr          byte
+
+	srcAddr uint16
+	count   byte
+}
+
+// NewScreen returns a blank screen for vm of width by height cells, each at
+// most 255.
+func NewScreen(vm *vm.VM, width, height int) *Screen {
+	s := &Screen{
+		vm:            vm,
+		width:         width,
+		height:        height,
+		cells:         make([]Cell, width*height),
+		cursorVisible: true,
+		attr:          DefaultAttr,
+	}
+	s.clear()
+	return s
+}
+
+func (s *Screen) Write(addr uint16, data byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch addr & 0x000F {
+	case 0x03:
+		s.cursorX = min(int(data), s.width-1)
+	case 0x04:
+		s.cursorY = min(int(data), s.height-1)
+	case 0x05:
+		s.attr = data
+	case 0x06:
+		s.put(data)
+	case 0x07:
+		s.command(data)
+	case 0x08:
+		s.srcAddr = (uint16(data) << 8) | (s.srcAddr & 0x00FF)
+	case 0x09:
+		s.srcAddr = (uint16(data)) | (s.srcAddr & 0xFF00)
+	case 0x0A:
+		s.count = data
+	case 0x0B:
+		s.cursorVisible = data&0x01 != 0
+	}
+}
+
+func (s *Screen) Read(addr uint16) byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch addr & 0x000F {
+	case 0x00:
+		return ScreenDeviceType
+	case 0x01:
+		return byte(s.width)
+	case 0x02:
+		return byte(s.height)
+	case 0x03:
+		return byte(s.cursorX)
+	case 0x04:
+		return byte(s.cursorY)
+	case 0x05:
+		return s.attr
+	case 0x08:
+		return byte(s.srcAddr >> 8)
+	case 0x09:
+		return byte(s.srcAddr & 0x00FF)
+	case 0x0A:
+		return s.count
+	case 0x0B:
+		if s.cursorVisible {
+			return 0x01
+		}
+		return 0
+	}
+	return 0
+}
+
+func (s *Screen) command(cmd byte) {
+	switch cmd {
+	case ScreenClear:
+		s.clear()
+	case ScreenScroll:
+		s.scroll(int(s.count))
+	case ScreenBlitCells:
+		data := s.vm.MMIO.ReadData(s.srcAddr, min(2*int(s.count), 0x10000-int(s.srcAddr)))
+		for i := 0; i+1 < len(data); i += 2 {
+			s.blit(i/2, Cell{Char: data[i], Attr: data[i+1]})
+		}
+	case ScreenBlitText:
+		for i, c := range s.vm.MMIO.ReadData(s.srcAddr, min(int(s.count), 0x10000-int(s.srcAddr))) {
+			s.blit(i, Cell{Char: c, Attr: s.attr})
+		}
+	}
+}
+
+// blit sets the cell n cells on from the cursor, if it is on screen.
+func (s *Screen) blit(n int, c Cell) {
+	i := s.cursorY*s.width + s.cursorX + n
+	if i < len(s.cells) {
+		s.cells[i] = c
+	}
+}
+
+func (s *Screen) put(c byte) {
+	switch c {
+	case '\n':
+		s.cursorX = 0
+		s.cursorY++
+	case '\r':
+		s.cursorX = 0
+	case '\b':
+		if s.cursorX > 0 {
+			s.cursorX--
+		}
+	default:
+		s.cells[s.cursorY*s.width+s.cursorX] = Cell{Char: c, Attr: s.attr}
+		s.cursorX++
+		if s.cursorX == s.width {
+			s.cursorX = 0
+			s.cursorY++
+		}
+	}
+	if s.cursorY == s.height {
+		s.scroll(1)
+		s.cursorY = s.height - 1
+	}
+}
+
+func (s *Screen) clear() {
+	for i := range s.cells {
+		s.cells[i] = Cell{Char: ' ', Attr: s.attr}
+	}
+	s.cursorX, s.cursorY = 0, 0
+}
+
+func (s *Screen) scroll(lines int) {
+	lines = min(lines, s.height)
+	copy(s.cells, s.cells[lines*s.width:])
+	for i := (s.height - lines) * s.width; i < len(s.cells); i++ {
+		s.cells[i] = Cell{Char: ' ', Attr: s.attr}
+	}
+}
+
+// Grid returns a copy of the screen. It may be called from any goroutine.
+func (s *Screen) Grid() Grid {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Grid{
+		Width:         s.width,
+		Height:        s.height,
+		Cells:         append([]Cell(nil), s.cells...),
+		CursorX:       s.cursorX,
+		CursorY:       s.cursorY,
+		CursorVisible: s.cursorVisible,
+	}
+}
+
+// SaveState saves the registers and every cell.
+func (s *Screen) SaveState() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var visible byte
+	if s.cursorVisible {
+		visible = 0x01
+	}
+	data := []byte{
+		byte(s.width), byte(s.height), byte(s.cursorX), byte(s.cursorY), s.attr,
+		byte(s.srcAddr >> 8), byte(s.srcAddr), s.count, visible,
+	}
+	for _, c := range s.cells {
+		data = append(data, c.Char, c.Attr)
+	}
+	return data, nil
+}
+
+func (s *Screen) LoadState(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(data) != 9+2*len(s.cells) || int(data[0]) != s.width || int(data[1]) != s.height {
+		return errors.New("screen: bad state length")
+	}
+	s.cursorX, s.cursorY = min(int(data[2]), s.width-1), min(int(data[3]), s.height-1)
+	s.attr = data[4]
+	s.srcAddr = uint16(data[5])<<8 | uint16(data[6])
+	s.count = data[7]
+	s.cursorVisible = data[8]&0x01 != 0
+	for i := range s.cells {
+		s.cells[i] = Cell{Char: data[9+2*i], Attr: data[10+2*i]}
+	}
+	return nil
+}
+
+// ScreenRenderer shows a screen's grid on the host.
+type ScreenRenderer interface {
+	Render(g Grid) error
+}
+
+// Render draws the screen with r.
+func (s *Screen) Render(r ScreenRenderer) error {
+	return r.Render(s.Grid())
+}
+
+// MemoryRenderer keeps the last grid it rendered, for tests and hosts
+// without a display.
+type MemoryRenderer struct {
+	mu   sync.Mutex
+	last Grid
+}
+
+func (r *MemoryRenderer) Render(g Grid) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last = g
+	return nil
+}
+
+// Grid returns the last grid rendered.
+func (r *MemoryRenderer) Grid() Grid {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// ANSIRenderer draws grids to a terminal with ANSI escape codes, redrawing
+// the whole screen each time.
+type ANSIRenderer struct {
+	Out io.Writer
+}
+
+// ansiColours maps CGA colours to SGR foreground codes; add 10 for the
+// background.
+var ansiColours = [16]int{30, 34, 32, 36, 31, 35, 33, 37, 90, 94, 92, 96, 91, 95, 93, 97}
+
+func (r ANSIRenderer) Render(g Grid) error {
+	w := bufio.NewWriter(r.Out)
+	w.WriteString("\x1b[?25l\x1b[H")
+	last := -1
+	for y := range g.Height {
+		for x := range g.Width {
+			c := g.Cell(x, y)
+			if int(c.Attr) != last {
+				fmt.Fprintf(w, "\x1b[%d;%dm", ansiColours[c.Attr&0x0F], ansiColours[c.Attr>>4]+10)
+				last = int(c.Attr)
+			}
+			w.WriteByte(printable(c.Char))
+		}
+		w.WriteString("\x1b[0m\r\n")
+		last = -1
+	}
+	fmt.Fprintf(w, "\x1b[%d;%dH", g.CursorY+1, g.CursorX+1)
+	if g.CursorVisible {
+		w.WriteString("\x1b[?25h")
+	}
+	return w.Flush()
+}
+
+// cgaColours is the 16 colour CGA palette.
+var cgaColours = [16]color.RGBA{
+	{0x00, 0x00, 0x00, 0xFF}, {0x00, 0x00, 0xAA, 0xFF}, {0x00, 0xAA, 0x00, 0xFF}, {0x00, 0xAA, 0xAA, 0xFF},
+	{0xAA, 0x00, 0x00, 0xFF}, {0xAA, 0x00, 0xAA, 0xFF}, {0xAA, 0x55, 0x00, 0xFF}, {0xAA, 0xAA, 0xAA, 0xFF},
+	{0x55, 0x55, 0x55, 0xFF}, {0x55, 0x55, 0xFF, 0xFF}, {0x55, 0xFF, 0x55, 0xFF}, {0x55, 0xFF, 0xFF, 0xFF},
+	{0xFF, 0x55, 0x55, 0xFF}, {0xFF, 0x55, 0xFF, 0xFF}, {0xFF, 0xFF, 0x55, 0xFF}, {0xFF, 0xFF, 0xFF, 0xFF},
+}
+
+// ImageRenderer draws grids into an image with the 8x8 font, showing the
+// cursor as an underline.
+type ImageRenderer struct {
+	mu  sync.Mutex
+	img *image.RGBA
+}
+
+func (r *ImageRenderer) Render(g Grid) error {
+	img := image.NewRGBA(image.Rect(0, 0, 8*g.Width, 8*g.Height))
+	for y := range g.Height {
+		for x := range g.Width {
+			c := g.Cell(x, y)
+			fg, bg := cgaColours[c.Attr&0x0F], cgaColours[c.Attr>>4]
+			rows := glyph(printable(c.Char))
+			if g.CursorVisible && x == g.CursorX && y == g.CursorY {
+				rows[7] = 0xFF
+			}
+			for row, bits := range rows {
+				for col := range 8 {
+					px := bg
+					if bits&(1<<col) != 0 {
+						px = fg
+					}
+					img.SetRGBA(8*x+col, 8*y+row, px)
+				}
+			}
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.img = img
+	return nil
+}
+
+// Image returns the last grid rendered, or nil.
+func (r *ImageRenderer) Image() *image.RGBA {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.img
+}
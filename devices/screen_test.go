@@ -0,0 +1,189 @@
+package devices
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+func runScreen(t *testing.T, width, height int, src string) *Screen {
+	t.Helper()
+	m := vm.New()
+	m.LoadProgram(assemble(t, src))
+	screen := NewScreen(m, width, height)
+	m.RegisterDevice(2, screen)
+	if stop := m.RunSync(context.Background()); stop.Reason != vm.StopHalted {
+		t.Fatalf("got %v, want halted", stop.Reason)
+	}
+	return screen
+}
+
+// puts writes s to the screen in slot 2 one character at a time
+func puts(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		fmt.Fprintf(&b, "push16 0x0326\npush %d\nstore\n", c)
+	}
+	return b.String()
+}
+
+func TestScreenPut(t *testing.T) {
+	screen := runScreen(t, 8, 3, puts("hello\nwrapping line\nx\bX")+"halt")
+	g := screen.Grid()
+	if want := "wrapping\n line\nX"; g.Text() != want {
+		t.Fatalf("got\n%s\nwant\n%s", g.Text(), want)
+	}
+	if g.CursorX != 1 || g.CursorY != 2 {
+		t.Fatalf("cursor at %d,%d, want 1,2", g.CursorX, g.CursorY)
+	}
+}
+
+func TestScreenCommands(t *testing.T) {
+	screen := runScreen(t, 6, 3, `
+push16 0x1000
+push16 'ab'
+store16
+push16 0x1002
+push16 'cd'
+store16
+push16 0x1010
+push 'x'
+store
+push16 0x1012
+push 'y'
+store
+push16 0x1011
+push 0x02
+store
+push16 0x1013
+push 0x01
+store
+
+// text blit "abcd" from 4,0
+push16 0x0325
+push 0x1E
+store
+push16 0x0328
+push16 0x1000
+store16
+push16 0x032A
+push 4
+store
+push16 0x0323
+push 4
+store
+push16 0x0327
+push 4
+store
+
+// cell blit 2 cells from 0,2
+push16 0x0328
+push16 0x1010
+store16
+push16 0x032A
+push 2
+store
+push16 0x0323
+push 0
+store
+push16 0x0324
+push 2
+store
+push16 0x0327
+push 3
+store
+
+// scroll a line
+push16 0x0325
+push 0x07
+store
+push16 0x032A
+push 1
+store
+push16 0x0327
+push 2
+store
+halt
+`)
+	g := screen.Grid()
+	if want := "cd\nxy"; g.Text() != want {
+		t.Fatalf("got\n%s\nwant\n%s", g.Text(), want)
+	}
+	for _, c := range []struct {
+		x, y int
+		want Cell
+	}{
+		{0, 0, Cell{'c', 0x1E}},
+		{0, 1, Cell{'x', 0x02}},
+		{1, 1, Cell{'y', 0x01}},
+		{0, 2, Cell{' ', 0x07}},
+	} {
+		if got := g.Cell(c.x, c.y); got != c.want {
+			t.Errorf("cell %d,%d: got %+v, want %+v", c.x, c.y, got, c.want)
+		}
+	}
+}
+
+func TestScreenBlitEndOfMemory(t *testing.T) {
+	m := vm.New()
+	screen := NewScreen(m, 4, 1)
+	m.RegisterDevice(2, screen)
+	m.Inspect(func(m *vm.VM) {
+		m.MMIO.WriteData(0xFFFD, []byte{'a', 'b', 0x02})
+		m.MMIO.Write(0x0325, 0x07)
+		m.MMIO.Write(0x0328, 0xFF)
+		m.MMIO.Write(0x0329, 0xFD)
+		m.MMIO.Write(0x032A, 10)
+		m.MMIO.Write(0x0327, ScreenBlitText)
+		// only one whole cell is left, the last byte is ignored
+		m.MMIO.Write(0x0323, 3)
+		m.MMIO.Write(0x0327, ScreenBlitCells)
+	})
+	g := screen.Grid()
+	if want := "ab?a"; g.Text() != want {
+		t.Fatalf("got %q, want %q", g.Text(), want)
+	}
+	if got := g.Cell(3, 0); got != (Cell{'a', 'b'}) {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestScreenANSI(t *testing.T) {
+	screen := runScreen(t, 2, 1, `
+push16 0x0325
+push 0x4F
+store
+`+puts("o")+`
+push16 0x032B
+push 0
+store
+halt
+`)
+	var out bytes.Buffer
+	if err := screen.Render(ANSIRenderer{Out: &out}); err != nil {
+		t.Fatal(err)
+	}
+	want := "\x1b[?25l\x1b[H\x1b[97;41mo\x1b[37;40m \x1b[0m\r\n\x1b[1;2H"
+	if got := out.String(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	var mem MemoryRenderer
+	screen.Render(&mem)
+	if got := mem.Grid().Text(); got != "o" {
+		t.Fatalf("got %q", got)
+	}
+
+	state, _ := screen.SaveState()
+	restored := NewScreen(nil, 2, 1)
+	if err := restored.LoadState(state); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Grid().Cell(0, 0) != (Cell{'o', 0x4F}) {
+		t.Fatal("restored screen differs")
+	}
+}
@@ -0,0 +1,529 @@
+package devices
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+// Restart says when a service is restarted after its VM stops.
+type Restart string
+
+const (
+	RestartNever     Restart = "never"
+	RestartOnFailure Restart = "on-failure" // after a fault, or a kill the supervisor did not ask for
+	RestartAlways    Restart = "always"
+)
+
+// RestartPolicy controls how a service is restarted. Each restart waits
+// Backoff, doubling after every restart up to MaxBackoff. MaxRestarts limits
+// the number of restarts, 0 for no limit.
+type RestartPolicy struct {
+	Policy      Restart
+	MaxRestarts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+func (p *RestartPolicy) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Policy      Restart `json:"policy"`
+		MaxRestarts int     `json:"max_restarts"`
+		Backoff     string  `json:"backoff"`
+		MaxBackoff  string  `json:"max_backoff"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*p = RestartPolicy{Policy: raw.Policy, MaxRestarts: raw.MaxRestarts}
+	var err error
+	if raw.Backoff != "" {
+		if p.Backoff, err = time.ParseDuration(raw.Backoff); err != nil {
+			return err
+		}
+	}
+	if raw.MaxBackoff != "" {
+		if p.MaxBackoff, err = time.ParseDuration(raw.MaxBackoff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p RestartPolicy) restarts(failed bool) bool {
+	switch p.Policy {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return failed
+	}
+	return false
+}
+
+// delay returns how long to wait before restart number n, counting from 0.
+func (p RestartPolicy) delay(n int) time.Duration {
+	d := p.Backoff << min(n, 16)
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// DeviceSpec wires a device into a service's VM.
+//
+// Type is one of:
+//
+//	switch                 a port on the switch named by Network
+//	terminal               a terminal
+//	clock                  a clock on the host's time
+//	screen                 an 80x25 screen
+//	graphics               a graphics device
+//	input                  a keyboard and mouse input device
+//	interrupt-controller   an interrupt controller
+//	supervisor             a SupervisorDevice for querying services
+//	system                 a SystemDevice; programs it spawns are given a
+//	                       switch port in slot 0 on Network, if set
+type DeviceSpec struct {
+	Slot    int    `json:"slot"`
+	Type    string `json:"type"`
+	Network string `json:"network,omitempty"`
+}
+
+// Service describes a program the supervisor keeps running.
+type Service struct {
+	Name    string        `json:"name"`
+	Program string        `json:"program"`
+	Devices []DeviceSpec  `json:"devices"`
+	Restart RestartPolicy `json:"restart"`
+}
+
+// ReadServices reads a JSON list of services, for example:
+//
+//	[{
+//		"name": "receiver",
+//		"program": "progs/receiver.ca",
+//		"devices": [
+//			{"slot": 0, "type": "switch", "network": "net"},
+//			{"slot": 1, "type": "terminal"}
+//		],
+//		"restart": {"policy": "on-failure", "max_restarts": 5, "backoff": "100ms", "max_backoff": "5s"}
+//	}]
+func ReadServices(r io.Reader) ([]Service, error) {
+	var services []Service
+	if err := json.NewDecoder(r).Decode(&services); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+var serviceDevices = map[string]func(sv *Supervisor, svc *service, spec DeviceSpec, m *vm.VM){
+	"switch": func(sv *Supervisor, svc *service, spec DeviceSpec, m *vm.VM) {
+		sw := sv.Network(spec.Network)
+		sv.mu.Lock()
+		port, ok := svc.ports[spec.Network]
+		sv.mu.Unlock()
+		if ok {
+			sw.Reattach(port, spec.Slot, m)
+			return
+		}
+		port = sw.Attach(spec.Slot, m)
+		sv.mu.Lock()
+		svc.ports[spec.Network] = port
+		sv.mu.Unlock()
+	},
+	"terminal": func(sv *Supervisor, svc *service, spec DeviceSpec, m *vm.VM) {
+		m.RegisterDevice(spec.Slot, NewTerminal(m, spec.Slot))
+	},
+	"screen": func(sv *Supervisor, svc *service, spec DeviceSpec, m *vm.VM) {
+		m.RegisterDevice(spec.Slot, NewScreen(m, ScreenWidth, ScreenHeight))
+	},
+	"graphics": func(sv *Supervisor, svc *service, spec DeviceSpec, m *vm.VM) {
+		m.RegisterDevice(spec.Slot, NewGraphics(m))
+	},
+	"input": func(sv *Supervisor, svc *service, spec DeviceSpec, m *vm.VM) {
+		m.RegisterDevice(spec.Slot, NewInputDevice(m, spec.Slot))
+	},
+	"clock": func(sv *Supervisor, svc *service, spec DeviceSpec, m *vm.VM) {
+		m.RegisterDevice(spec.Slot, NewClock(m, spec.Slot, RealTime{}))
+	},
+	"interrupt-controller": func(sv *Supervisor, svc *service, spec DeviceSpec, m *vm.VM) {
+		m.RegisterDevice(spec.Slot, vm.NewInterruptController())
+	},
+	"supervisor": func(sv *Supervisor, svc *service, spec DeviceSpec, m *vm.VM) {
+		m.RegisterDevice(spec.Slot, NewSupervisorDevice(sv, m))
+	},
+	"system": func(sv *Supervisor, svc *service, spec DeviceSpec, m *vm.VM) {
+		var options []SpawnOption
+		if spec.Network != "" {
+			sw := sv.Network(spec.Network)
+			options = append(options, func(child *vm.VM) {
+				sw.Attach(0, child)
+			})
+		}
+		m.RegisterDevice(spec.Slot, NewSystemDevice(sv.sys, spec.Slot, m, sv.load, options...))
+	},
+}
+
+type ServiceState byte
+
+const (
+	ServicePending    ServiceState = iota // not started yet
+	ServiceRunning                        // its VM is running or waiting
+	ServiceRestarting                     // waiting out the backoff before a restart
+	ServiceStopped                        // halted and not restarted, or stopped by the supervisor
+	ServiceFailed                         // faulted or was killed and not restarted
+)
+
+func (s ServiceState) String() string {
+	switch s {
+	case ServicePending:
+		return "pending"
+	case ServiceRunning:
+		return "running"
+	case ServiceRestarting:
+		return "restarting"
+	case ServiceStopped:
+		return "stopped"
+	case ServiceFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("ServiceState(%d)", int(s))
+}
+
+// ServiceStatus reports on a supervised service.
+type ServiceStatus struct {
+	Name     string
+	State    ServiceState
+	VM       uint8 // the service's VM while it is running
+	Restarts int
+	LastExit Process // how the VM last stopped, if it has
+}
+
+type service struct {
+	Service
+	program []byte
+	ports   map[string]byte // switch port by network, kept across restarts
+
+	state    ServiceState
+	vm       uint8
+	restarts int
+	lastExit Process
+	timer    *time.Timer
+}
+
+type SupervisorOption func(*Supervisor)
+
+// WithLoader sets how service programs are loaded. It defaults to
+// LoadProgramFile.
+func WithLoader(load ProgramLoader) SupervisorOption {
+	return func(sv *Supervisor) {
+		sv.load = load
+	}
+}
+
+// Supervisor is the init service: it boots a list of services on a System and
+// restarts them according to their restart policies.
+type Supervisor struct {
+	sys  *System
+	load ProgramLoader
+
+	mu       sync.Mutex
+	services []*service
+	machines map[*vm.VM]*service
+	networks map[string]*Switch
+	stopped  bool
+}
+
+// NewSupervisor loads the programs of services and checks their devices.
+// Nothing runs until Start.
+func NewSupervisor(sys *System, services []Service, opts ...SupervisorOption) (*Supervisor, error) {
+	sv := &Supervisor{
+		sys:      sys,
+		load:     LoadProgramFile,
+		machines: map[*vm.VM]*service{},
+		networks: map[string]*Switch{},
+	}
+	for _, opt := range opts {
+		opt(sv)
+	}
+	names := map[string]bool{}
+	for _, s := range services {
+		if names[s.Name] {
+			return nil, fmt.Errorf("service %s: defined twice", s.Name)
+		}
+		names[s.Name] = true
+		switch s.Restart.Policy {
+		case "", RestartNever, RestartOnFailure, RestartAlways:
+		default:
+			return nil, fmt.Errorf("service %s: unknown restart policy %q", s.Name, s.Restart.Policy)
+		}
+		for _, d := range s.Devices {
+			if _, ok := serviceDevices[d.Type]; !ok {
+				return nil, fmt.Errorf("service %s: unknown device type %q", s.Name, d.Type)
+			}
+			if d.Slot < 0 || d.Slot > 0x0F {
+				return nil, fmt.Errorf("service %s: bad device slot %d", s.Name, d.Slot)
+			}
+			if d.Type == "switch" && d.Network == "" {
+				return nil, fmt.Errorf("service %s: switch in slot %d has no network", s.Name, d.Slot)
+			}
+		}
+		program, err := sv.load(s.Program)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", s.Name, err)
+		}
+		sv.services = append(sv.services, &service{
+			Service: s,
+			program: program,
+			ports:   map[string]byte{},
+		})
+	}
+	sys.OnSpawn(sv.spawned)
+	sys.OnHalt(sv.exited)
+	sys.OnFault(sv.exited)
+	return sv, nil
+}
+
+// Network returns the switch services name in their switch devices, creating
+// it if needed, so that host code can attach to it too.
+func (sv *Supervisor) Network(name string) *Switch {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	sw, ok := sv.networks[name]
+	if !ok {
+		sw = NewSwitch()
+		sv.networks[name] = sw
+	}
+	return sw
+}
+
+// Start boots every service in order.
+func (sv *Supervisor) Start() error {
+	for _, svc := range sv.services {
+		if err := sv.start(svc); err != nil {
+			return fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+	}
+	return nil
+}
+
+func (sv *Supervisor) start(svc *service) error {
+	_, err := sv.sys.Spawn(svc.program, func(m *vm.VM) {
+		sv.mu.Lock()
+		sv.machines[m] = svc
+		sv.mu.Unlock()
+		for _, d := range svc.Devices {
+			serviceDevices[d.Type](sv, svc, d, m)
+		}
+	})
+	if err != nil {
+		sv.mu.Lock()
+		svc.state = ServiceFailed
+		sv.mu.Unlock()
+	}
+	return err
+}
+
+func (sv *Supervisor) spawned(p Process) {
+	m, err := sv.sys.GetVM(p.ID)
+	if err != nil {
+		return
+	}
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if svc, ok := sv.machines[m]; ok {
+		svc.vm = p.ID
+		svc.state = ServiceRunning
+	}
+}
+
+func (sv *Supervisor) exited(p Process) {
+	m, err := sv.sys.GetVM(p.ID)
+	if err != nil {
+		return
+	}
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	svc, ok := sv.machines[m]
+	if !ok {
+		return
+	}
+	delete(sv.machines, m)
+	svc.lastExit = p
+	failed := p.State != StateHalted
+	policy := svc.Restart
+	switch {
+	case sv.stopped:
+		svc.state = ServiceStopped
+	case !policy.restarts(failed) && failed:
+		svc.state = ServiceFailed
+	case !policy.restarts(failed):
+		svc.state = ServiceStopped
+	case policy.MaxRestarts > 0 && svc.restarts >= policy.MaxRestarts && failed:
+		svc.state = ServiceFailed
+	case policy.MaxRestarts > 0 && svc.restarts >= policy.MaxRestarts:
+		svc.state = ServiceStopped
+	default:
+		svc.state = ServiceRestarting
+		svc.timer = time.AfterFunc(policy.delay(svc.restarts), func() {
+			sv.restart(svc)
+		})
+	}
+}
+
+func (sv *Supervisor) restart(svc *service) {
+	sv.mu.Lock()
+	if sv.stopped || svc.state != ServiceRestarting {
+		sv.mu.Unlock()
+		return
+	}
+	svc.restarts++
+	sv.mu.Unlock()
+	sv.start(svc)
+}
+
+// Stop kills every service and cancels pending restarts.
+func (sv *Supervisor) Stop() {
+	sv.mu.Lock()
+	sv.stopped = true
+	var running []uint8
+	for _, svc := range sv.services {
+		switch svc.state {
+		case ServiceRunning:
+			running = append(running, svc.vm)
+		case ServiceRestarting:
+			svc.timer.Stop()
+			svc.state = ServiceStopped
+		}
+	}
+	sv.mu.Unlock()
+	for _, id := range running {
+		sv.sys.Kill(id)
+	}
+}
+
+// Status reports on every service, in the order they were defined.
+func (sv *Supervisor) Status() []ServiceStatus {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	out := make([]ServiceStatus, len(sv.services))
+	for i, svc := range sv.services {
+		out[i] = svc.status()
+	}
+	return out
+}
+
+// Service reports on the named service.
+func (sv *Supervisor) Service(name string) (ServiceStatus, error) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	for _, svc := range sv.services {
+		if svc.Name == name {
+			return svc.status(), nil
+		}
+	}
+	return ServiceStatus{}, errors.New("service not found")
+}
+
+func (svc *service) status() ServiceStatus {
+	return ServiceStatus{
+		Name:     svc.Name,
+		State:    svc.state,
+		VM:       svc.vm,
+		Restarts: svc.restarts,
+		LastExit: svc.lastExit,
+	}
+}
+
+const SupervisorDeviceType = 0x09
+
+/**
+Supervisor Device
+
+Lets a VM query the services of the supervisor that started it. Services are
+numbered in the order they were defined.
+
+Reg  Addr   Name              R/W   Description
+---  ----   ----              ---   -----------
+0    0x00   device_type       R     0x09 = supervisor
+1    0x01   service_count     R     number of services
+2    0x02   select            RW    number of the service to query
+3    0x03   state             R     0 pending, 1 running, 2 restarting, 3 stopped, 4 failed
+4    0x04   vm_id             R     VM of the service while running
+5    0x05   restarts          R     times the service has been restarted, up to 255
+6    0x06   name_addr_high    W
+7    0x07   name_addr_low     W
+8    0x08   name_length       R     length of the service's name
+9    0x09   name_trigger      W     copy the service's name to name_addr, up to the end of memory
+
+**/
+
+type SupervisorDevice struct {
+	sv       *Supervisor
+	vm       *vm.VM
+	selected byte
+	NameAddr uint16
+}
+
+func NewSupervisorDevice(sv *Supervisor, vm *vm.VM) *SupervisorDevice {
+	return &SupervisorDevice{
+		sv: sv,
+		vm: vm,
+	}
+}
+
+func (d *SupervisorDevice) Write(addr uint16, data byte) {
+	switch addr & 0x000F {
+	case 0x02:
+		d.selected = data
+	case 0x06:
+		d.NameAddr = (uint16(data) << 8) | (d.NameAddr & 0x00FF)
+	case 0x07:
+		d.NameAddr = (uint16(data)) | (d.NameAddr & 0xFF00)
+	case 0x09:
+		if s, ok := d.status(); ok {
+			// names running past the end of memory are cut short
+			name := []byte(s.Name)
+			d.vm.MMIO.WriteData(d.NameAddr, name[:min(len(name), 0x10000-int(d.NameAddr))])
+		}
+	}
+}
+
+func (d *SupervisorDevice) Read(addr uint16) byte {
+	switch addr & 0x000F {
+	case 0x00:
+		return SupervisorDeviceType
+	case 0x01:
+		return byte(min(len(d.sv.Status()), 255))
+	case 0x02:
+		return d.selected
+	}
+	s, ok := d.status()
+	if !ok {
+		return 0
+	}
+	switch addr & 0x000F {
+	case 0x03:
+		return byte(s.State)
+	case 0x04:
+		return s.VM
+	case 0x05:
+		return byte(min(s.Restarts, 255))
+	case 0x08:
+		return byte(min(len(s.Name), 255))
+	}
+	return 0
+}
+
+func (d *SupervisorDevice) status() (ServiceStatus, bool) {
+	status := d.sv.Status()
+	if int(d.selected) >= len(status) {
+		return ServiceStatus{}, false
+	}
+	return status[d.selected], true
+}
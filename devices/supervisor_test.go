@@ -0,0 +1,234 @@
+package devices
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+// queryProgram stores its own service state and VM ID at 0x1000, the length
+// of its name at 0x1002 and its name at 0x1010
+const queryProgram = `
+push16 0x1000
+push16 0x0313
+load
+store
+push16 0x1001
+push16 0x0314
+load
+store
+push16 0x1002
+push16 0x0318
+load
+store
+push16 0x0316
+push16 0x1010
+store16
+push16 0x0319
+push 1
+store
+halt
+`
+
+func programs(t *testing.T) ProgramLoader {
+	sources := map[string]string{
+		"echo":  fmt.Sprintf(wakeProgram, 0),
+		"query": queryProgram,
+		"timer": fmt.Sprintf(timerProgram, 0x03),
+	}
+	return func(name string) ([]byte, error) {
+		switch name {
+		case "halt":
+			return []byte{vm.HaltInstruction}, nil
+		case "fault":
+			return []byte{0x30}, nil
+		}
+		return assemble(t, sources[name]), nil
+	}
+}
+
+func startServices(t *testing.T, sys *System, config string) *Supervisor {
+	t.Helper()
+	services, err := ReadServices(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sv, err := NewSupervisor(sys, services, WithLoader(programs(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sv.Stop)
+	return sv
+}
+
+func serviceIn(t *testing.T, sv *Supervisor, name string, state ServiceState) ServiceStatus {
+	t.Helper()
+	var s ServiceStatus
+	waitFor(t, name+" to be "+state.String(), func() bool {
+		s, _ = sv.Service(name)
+		return s.State == state
+	})
+	return s
+}
+
+func TestSupervisorRestartPolicies(t *testing.T) {
+	sys := NewSystem()
+	defer sys.Close()
+	sv := startServices(t, sys, `[
+		{"name": "crashy", "program": "fault", "restart": {"policy": "on-failure", "max_restarts": 3, "backoff": "1ms"}},
+		{"name": "oneshot", "program": "halt", "restart": {"policy": "on-failure"}},
+		{"name": "looping", "program": "halt", "restart": {"policy": "always", "max_restarts": 2}},
+		{"name": "fragile", "program": "fault"}
+	]`)
+
+	s := serviceIn(t, sv, "crashy", ServiceFailed)
+	if s.Restarts != 3 || s.LastExit.State != StateFaulted || s.LastExit.Exit.Fault.Cause != vm.FaultInvalidOpcode {
+		t.Errorf("crashy: got %+v, want 3 restarts then an invalid opcode fault", s)
+	}
+	if s := serviceIn(t, sv, "oneshot", ServiceStopped); s.Restarts != 0 || s.LastExit.State != StateHalted {
+		t.Errorf("oneshot: got %+v, want halted without a restart", s)
+	}
+	if s := serviceIn(t, sv, "looping", ServiceStopped); s.Restarts != 2 {
+		t.Errorf("looping: got %d restarts, want 2", s.Restarts)
+	}
+	if s := serviceIn(t, sv, "fragile", ServiceFailed); s.Restarts != 0 {
+		t.Errorf("fragile: got %d restarts, want 0", s.Restarts)
+	}
+}
+
+func TestSupervisorKeepsSwitchPort(t *testing.T) {
+	sys := NewSystem()
+	defer sys.Close()
+	sv := startServices(t, sys, `[
+		{"name": "first", "program": "echo", "devices": [{"slot": 0, "type": "switch", "network": "net"}]},
+		{"name": "echo", "program": "echo", "devices": [{"slot": 0, "type": "switch", "network": "net"}],
+		 "restart": {"policy": "always"}}
+	]`)
+	net := sv.Network("net")
+
+	for i := range 3 {
+		s := serviceIn(t, sv, "echo", ServiceRunning)
+		if s.Restarts != i {
+			t.Fatalf("got %d restarts, want %d", s.Restarts, i)
+		}
+		waitFor(t, "echo to wait", func() bool {
+			for _, p := range sys.List() {
+				if p.ID == s.VM {
+					return p.State == StateWaiting
+				}
+			}
+			return false
+		})
+		// the restarted VM is still reached at port 1
+		if err := net.Send(0xFF, 1, 0, []byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "echo to restart", func() bool {
+			s, _ := sv.Service("echo")
+			return s.Restarts == i+1
+		})
+	}
+	if s, _ := sv.Service("first"); s.State != ServiceRunning {
+		t.Fatalf("first is %v, want running", s.State)
+	}
+
+	sv.Stop()
+	s := serviceIn(t, sv, "echo", ServiceStopped)
+	if s.LastExit.State != StateKilled && s.LastExit.State != StateHalted {
+		t.Fatalf("got last exit %v", s.LastExit.State)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if s, _ := sv.Service("echo"); s.State != ServiceStopped {
+		t.Fatalf("echo is %v after stopping", s.State)
+	}
+}
+
+func TestSupervisorDevice(t *testing.T) {
+	sys := NewSystem()
+	defer sys.Close()
+	sv := startServices(t, sys, `[
+		{"name": "query", "program": "query", "devices": [{"slot": 1, "type": "supervisor"}]}
+	]`)
+
+	s := serviceIn(t, sv, "query", ServiceStopped)
+	m, err := sys.GetVM(s.VM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	m.Inspect(func(m *vm.VM) {
+		got = append(m.MMIO.ReadData(0x1000, 3), m.MMIO.ReadData(0x1010, 5)...)
+	})
+	want := append([]byte{byte(ServiceRunning), s.VM, 5}, "query"...)
+	if string(got) != string(want) {
+		t.Fatalf("got % X, want % X", got, want)
+	}
+
+	// a name copied to the end of memory is cut short
+	d := NewSupervisorDevice(sv, m)
+	m.Inspect(func(m *vm.VM) {
+		d.Write(0x06, 0xFF)
+		d.Write(0x07, 0xFE)
+		d.Write(0x09, 1)
+		got = m.MMIO.ReadData(0xFFFE, 2)
+	})
+	if string(got) != "qu" {
+		t.Fatalf("got %q at the end of memory", got)
+	}
+}
+
+func TestSupervisorStopsClocks(t *testing.T) {
+	sys := NewSystem()
+	defer sys.Close()
+	sv := startServices(t, sys, `[
+		{"name": "timer", "program": "timer", "devices": [{"slot": 1, "type": "clock"}]}
+	]`)
+
+	s := serviceIn(t, sv, "timer", ServiceRunning)
+	m, err := sys.GetVM(s.VM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := m.Device(1).(*Clock)
+	waitFor(t, "a tick", func() bool {
+		count, _ := ticksAt(m)
+		return count > 0
+	})
+	if err := sys.Kill(s.VM); err != nil {
+		t.Fatal(err)
+	}
+	serviceIn(t, sv, "timer", ServiceFailed)
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	if clock.timers[2].armed {
+		t.Fatal("the clock of a killed service is still running")
+	}
+}
+
+func TestSupervisorConfigErrors(t *testing.T) {
+	sys := NewSystem()
+	defer sys.Close()
+	for _, config := range []string{
+		`[{"name": "a", "program": "halt", "devices": [{"slot": 0, "type": "toaster"}]}]`,
+		`[{"name": "a", "program": "halt", "devices": [{"slot": 0, "type": "switch"}]}]`,
+		`[{"name": "a", "program": "halt", "restart": {"policy": "sometimes"}}]`,
+		`[{"name": "a", "program": "halt"}, {"name": "a", "program": "halt"}]`,
+	} {
+		services, err := ReadServices(strings.NewReader(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewSupervisor(sys, services, WithLoader(programs(t))); err == nil {
+			t.Errorf("%s: expected an error", config)
+		}
+	}
+	if _, err := ReadServices(strings.NewReader(`[{"restart": {"backoff": "soon"}}]`)); err == nil {
+		t.Error("expected an error for a bad backoff")
+	}
+}
@@ -2,8 +2,9 @@ package devices
 
 import (
 	"errors"
-	"fmt"
+	"sync"
 
+	"github.com/alisdairrankine/frienvironment/lib"
 	"github.com/alisdairrankine/frienvironment/vm"
 )
 
@@ -33,6 +34,7 @@ Reg  Addr   Name              R/W   Description
 **/
 
 type Switch struct {
+	mu    sync.RWMutex
 	ports []*Port //todo: map[byte]*port
 }
 
@@ -40,7 +42,11 @@ func NewSwitch() *Switch {
 	return &Switch{}
 }
 
-func (s *Switch) Attach(deviceNum int, vm *vm.VM) {
+// Attach connects vm to a new port, registered as device deviceNum, and
+// returns the port's ID.
+func (s *Switch) Attach(deviceNum int, vm *vm.VM) byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	id := len(s.ports)
 	port := &Port{
 		deviceID: deviceNum,
@@ -50,16 +56,61 @@ func (s *Switch) Attach(deviceNum int, vm *vm.VM) {
 	}
 	vm.RegisterDevice(deviceNum, port)
 	s.ports = append(s.ports, port)
+	return byte(id)
+}
+
+// Reattach connects vm to an existing port in place of the VM attached
+// there, so that a restarted VM keeps its address.
+func (s *Switch) Reattach(id byte, deviceNum int, vm *vm.VM) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int(id) >= len(s.ports) {
+		return errors.New("host not found")
+	}
+	port := &Port{
+		deviceID: deviceNum,
+		s:        s,
+		vm:       vm,
+		port:     id,
+	}
+	vm.RegisterDevice(deviceNum, port)
+	s.ports[id] = port
+	return nil
 }
 
 func (s *Switch) Send(sourceAddr, destinationAddr, signalID byte, data []byte) error {
-	port := s.ports[destinationAddr]
+	s.mu.RLock()
+	var port *Port
+	if int(destinationAddr) < len(s.ports) {
+		port = s.ports[destinationAddr]
+	}
+	s.mu.RUnlock()
 	if port == nil {
 		return errors.New("host not found")
 	}
-	fmt.Println("send: ", string(data))
-	port.Receive(sourceAddr, signalID, data)
-	return nil
+	return port.Receive(sourceAddr, signalID, data)
+}
+
+// Fault returns the extended fault register of the VM attached at port id.
+func (s *Switch) Fault(id byte) (vm.FaultInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if int(id) >= len(s.ports) {
+		return vm.FaultInfo{}, errors.New("host not found")
+	}
+	return s.ports[id].vm.Fault(), nil
+}
+
+// SendValue encodes v as CaperData and sends it as the message payload.
+func (s *Switch) SendValue(sourceAddr, destinationAddr, signalID byte, v any) error {
+	data, err := lib.EncodeCaperData(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0xFF {
+		return errors.New("payload too long")
+	}
+	return s.Send(sourceAddr, destinationAddr, signalID, data)
 }
 
 type Port struct {
@@ -80,12 +131,62 @@ type Port struct {
 	callbackAddr    uint16
 }
 
-func (p *Port) Receive(sourceAddr, signalID byte, data []byte) {
-	p.senderPort = sourceAddr
-	p.receiveSignal = signalID
-	p.vm.MMIO.WriteData(p.recvAddr, data)
+// Receive delivers a message to the port's VM. It may be called from any
+// goroutine; the port registers and receive buffer are updated between the
+// receiving VM's instructions.
+func (p *Port) Receive(sourceAddr, signalID byte, data []byte) error {
+	p.vm.Deliver(SwitchDelivery{
+		Slot:   p.deviceID,
+		Source: sourceAddr,
+		Signal: signalID,
+		Data:   append([]byte(nil), data...),
+	})
+	return p.vm.RaiseInterrupt(p.deviceID)
+}
+
+// SwitchDelivery is the input applied to a VM when a message arrives at the
+// switch port in Slot.
+type SwitchDelivery struct {
+	Slot   int
+	Source byte
+	Signal byte
+	Data   []byte
+}
+
+func (d SwitchDelivery) Apply(m *vm.VM) {
+	p, ok := m.Device(d.Slot).(*Port)
+	if !ok {
+		return
+	}
+	p.senderPort = d.Source
+	p.receiveSignal = d.Signal
+	data := d.Data[:min(len(d.Data), 0x10000-int(p.recvAddr))]
+	m.MMIO.WriteData(p.recvAddr, data)
 	p.recvLength = byte(len(data))
-	p.vm.Interrupt(uint16((byte(p.deviceID)<<4)+0x0B) | 0x0300)
+}
+
+// SaveState saves the port registers. The port's ID belongs to the switch
+// and is not saved.
+func (p *Port) SaveState() ([]byte, error) {
+	return []byte{
+		p.destinationPort, p.senderPort, p.sendSignal, p.receiveSignal,
+		p.messageLength, p.recvLength,
+		byte(p.messageAddr >> 8), byte(p.messageAddr),
+		byte(p.recvAddr >> 8), byte(p.recvAddr),
+		byte(p.callbackAddr >> 8), byte(p.callbackAddr),
+	}, nil
+}
+
+func (p *Port) LoadState(data []byte) error {
+	if len(data) != 12 {
+		return errors.New("switch port: bad state length")
+	}
+	p.destinationPort, p.senderPort, p.sendSignal, p.receiveSignal = data[0], data[1], data[2], data[3]
+	p.messageLength, p.recvLength = data[4], data[5]
+	p.messageAddr = uint16(data[6])<<8 | uint16(data[7])
+	p.recvAddr = uint16(data[8])<<8 | uint16(data[9])
+	p.callbackAddr = uint16(data[10])<<8 | uint16(data[11])
+	return nil
 }
 
 func (p *Port) Write(addr uint16, data byte) {
@@ -106,12 +207,10 @@ func (p *Port) Write(addr uint16, data byte) {
 		p.recvAddr = (uint16(data)) | (p.recvAddr & 0xFF00)
 	case 0x0B:
 		p.callbackAddr = (uint16(data) << 8) | (p.callbackAddr & 0x00FF)
-		fmt.Printf("callback: %X\n", p.callbackAddr)
 	case 0x0C:
 		p.callbackAddr = (uint16(data)) | (p.callbackAddr & 0xFF00)
-		fmt.Printf("callback: %X\n", p.callbackAddr)
 	case 0x0D:
-		data := p.vm.MMIO.ReadData(p.messageAddr, int(p.messageLength))
+		data := p.vm.MMIO.ReadData(p.messageAddr, min(int(p.messageLength), 0x10000-int(p.messageAddr)))
 		p.s.Send(p.port, p.destinationPort, p.sendSignal, data)
 	}
 }
@@ -0,0 +1,154 @@
+package devices
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/alisdairrankine/frienvironment/assembler"
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+// ringProgram waits for a message, forwards it to the next port and halts.
+// The last port in the ring only halts.
+const ringProgram = `
+// receive into 0x1000
+push16 0x0309
+push16 0x1000
+store16
+push16 0x030B
+push16 on_message
+store16
+yield
+
+on_message:
+// destination is our port + 1
+push16 0x0302
+push16 0x0301
+load
+inc
+store
+
+push16 done
+push16 0x0301
+load
+push %d
+eq
+jnz
+
+push16 0x0307
+push16 0x1000
+store16
+push16 0x0306
+push16 0x030E
+load
+store
+push16 0x030D
+push 0
+store
+
+done:
+halt
+`
+
+func TestSwitchRing(t *testing.T) {
+	const size = 8
+	program, err := assembler.Assemble(fmt.Sprintf(ringProgram, size-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sw := NewSwitch()
+	machines := make([]*vm.VM, size)
+	var halted sync.WaitGroup
+	for i := range machines {
+		m := vm.New()
+		m.LoadProgram(program)
+		sw.Attach(0, m)
+		halted.Add(1)
+		m.OnStop(func(stop vm.Stop) {
+			if stop.Reason != vm.StopHalted {
+				t.Errorf("vm %d: %v", i, stop.Reason)
+			}
+			halted.Done()
+		})
+		if stop := m.RunSync(context.Background()); stop.Reason != vm.StopWaiting {
+			t.Fatalf("vm %d: got %v, want waiting", i, stop.Reason)
+		}
+		machines[i] = m
+	}
+	for _, m := range machines {
+		m.Run()
+	}
+
+	if err := sw.Send(0xFF, 0, 1, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	halted.Wait()
+
+	for i, m := range machines {
+		var got []byte
+		m.Inspect(func(m *vm.VM) {
+			got = append(got, m.MMIO.ReadData(0x1000, 4)...)
+		})
+		if !bytes.Equal(got, []byte("ping")) {
+			t.Errorf("vm %d received %q", i, got)
+		}
+	}
+}
+
+func TestSwitchUnknownHost(t *testing.T) {
+	if err := NewSwitch().Send(0, 3, 0, nil); err == nil {
+		t.Fatal("expected error sending to a missing port")
+	}
+}
+
+func TestSwitchFault(t *testing.T) {
+	s := NewSwitch()
+	m := vm.New()
+	m.LoadProgram([]byte{0x30})
+	s.Attach(0, m)
+	m.RunFor(1)
+
+	got, err := s.Fault(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (vm.FaultInfo{Cause: vm.FaultInvalidOpcode, PC: vm.AddrProgramStart, Opcode: 0x30}); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if _, err := s.Fault(1); err == nil {
+		t.Fatal("expected error for a missing port")
+	}
+}
+
+func TestSwitchEndOfMemory(t *testing.T) {
+	s := NewSwitch()
+	a, b := vm.New(), vm.New()
+	s.Attach(0, a)
+	s.Attach(0, b)
+
+	b.Inspect(func(m *vm.VM) {
+		m.MMIO.Write(0x0309, 0xFF)
+		m.MMIO.Write(0x030A, 0xFF)
+	})
+	// the message at the end of a's memory is cut short, and b only has room
+	// for its first byte
+	a.Inspect(func(m *vm.VM) {
+		m.MMIO.WriteData(0xFFFE, []byte("hi"))
+		m.MMIO.Write(0x0302, 1)
+		m.MMIO.Write(0x0306, 200)
+		m.MMIO.Write(0x0307, 0xFF)
+		m.MMIO.Write(0x0308, 0xFE)
+		m.MMIO.Write(0x030D, 1)
+	})
+	var length, last byte
+	b.Inspect(func(m *vm.VM) {
+		length, last = m.MMIO.Read(0x030E), m.MMIO.Read(0xFFFF)
+	})
+	if length != 1 || last != 'h' {
+		t.Fatalf("got %d bytes, %q at the end of memory", length, last)
+	}
+}
@@ -1,29 +1,101 @@
 package devices
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
 
 	"github.com/alisdairrankine/frienvironment/vm"
 )
 
 type System struct {
-	vms map[uint8]*vm.VM
+	mu sync.Mutex
+
+	procs map[uint8]*process
 
 	next uint8
 
 	dead []uint8
+
+	recorder  *Recorder
+	replay    *Recording
+	replaying sync.WaitGroup
+	replayErr []error
+
+	workers   int
+	timeSlice uint64
+	sched     *scheduler
+
+	spawnHooks []func(Process)
+	haltHooks  []func(Process)
+	faultHooks []func(Process)
+}
+
+type SystemOption func(*System)
+
+// WithWorkers sets how many goroutines execute VMs. It defaults to
+// GOMAXPROCS.
+func WithWorkers(n int) SystemOption {
+	return func(s *System) {
+		s.workers = n
+	}
+}
+
+// WithTimeSlice sets how many instructions a VM executes before its worker
+// moves on to the next runnable VM. It defaults to DefaultTimeSlice.
+func WithTimeSlice(instructions uint64) SystemOption {
+	return func(s *System) {
+		s.timeSlice = instructions
+	}
+}
+
+// NewSystem returns a system that runs its VMs on a pool of workers. Close
+// the system to stop the workers.
+func NewSystem(opts ...SystemOption) *System {
+	s := &System{
+		procs:     make(map[uint8]*process),
+		workers:   runtime.GOMAXPROCS(0),
+		timeSlice: DefaultTimeSlice,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.sched = newScheduler(max(s.workers, 1), max(s.timeSlice, 1), s.update)
+	return s
+}
+
+// Close stops the workers. VMs that have not halted are left where they
+// were.
+func (s *System) Close() {
+	s.sched.close()
 }
 
-func NewSystem() *System {
-	return &System{
-		vms: make(map[uint8]*vm.VM),
+// SetPriority sets the scheduling priority of a VM. Runnable VMs with a
+// higher priority are always run first; VMs start with priority 0.
+func (s *System) SetPriority(vmID uint8, priority int) error {
+	if !s.sched.setPriority(vmID, priority) {
+		return errors.New("vm not found")
 	}
+	return nil
+}
+
+// SetQuota limits the total number of instructions a VM may execute. A VM
+// that reaches its quota is parked until the quota is raised. A quota of 0
+// removes the limit.
+func (s *System) SetQuota(vmID uint8, cycles uint64) error {
+	if !s.sched.setQuota(vmID, cycles) {
+		return errors.New("vm not found")
+	}
+	return nil
 }
 
 type SpawnOption func(*vm.VM)
 
 func (s *System) Spawn(program []byte, spawnOptions ...SpawnOption) (id uint8, err error) {
-
+	s.mu.Lock()
 	if len(s.dead) > 0 {
 		id = s.dead[0]
 		s.dead = s.dead[1:]
@@ -32,30 +104,246 @@ func (s *System) Spawn(program []byte, spawnOptions ...SpawnOption) (id uint8, e
 			id = s.next
 			s.next++
 		} else {
+			s.mu.Unlock()
 			return 0, errors.New("no capacity")
 		}
 	}
+	p := &process{
+		Process: Process{ID: id, State: StateStarting},
+		done:    make(chan struct{}),
+	}
+	s.procs[id] = p
+	recorder, replay := s.recorder, s.replay
+	s.mu.Unlock()
+
+	var replayed *VMRecording
+	if replay != nil {
+		replayed = replay.vm(id)
+		if replayed == nil || !bytes.Equal(replayed.Program, program) {
+			s.mu.Lock()
+			delete(s.procs, id)
+			s.dead = append(s.dead, id)
+			s.mu.Unlock()
+			return 0, fmt.Errorf("vm %d does not match the recording", id)
+		}
+	}
+
 	machine := vm.New()
 	machine.LoadProgram(program)
+	// reset before any device can deliver to it, so a replay starts from
+	// the same point
+	machine.Reset()
+	if replayed != nil {
+		machine.Replay()
+	}
 	for _, opt := range spawnOptions {
 		opt(machine)
 	}
+	if recorder != nil {
+		recorder.attach(id, program, machine)
+	}
+
+	s.mu.Lock()
+	p.m = machine
+	p.State = StateRunning
+	info := p.Process
+	hooks := s.spawnHooks
+	s.mu.Unlock()
+	for _, hook := range hooks {
+		hook(info)
+	}
 
-	machine.Run()
+	if replayed != nil {
+		s.replaying.Add(1)
+		go func() {
+			defer s.replaying.Done()
+			stop, err := replayVM(machine, replayed)
+			if err != nil {
+				s.mu.Lock()
+				s.replayErr = append(s.replayErr, err)
+				s.mu.Unlock()
+			}
+			switch stop.Reason {
+			case vm.StopHalted, vm.StopFaulted:
+				s.update(id, taskDone, stop)
+			case vm.StopWaiting:
+				s.update(id, taskParked, stop)
+			}
+		}()
+		return id, nil
+	}
+	s.sched.add(id, machine)
 	return id, nil
 }
 
+// update moves a process to the state the scheduler found it in.
+func (s *System) update(id uint8, state taskState, stop vm.Stop) {
+	s.mu.Lock()
+	p, ok := s.procs[id]
+	if !ok || p.State.Ended() {
+		s.mu.Unlock()
+		return
+	}
+	switch state {
+	case taskParked:
+		p.State = StateWaiting
+	case taskDone:
+		p.Exit = stop.State
+		switch {
+		case p.killed:
+			p.State = StateKilled
+		case stop.Reason == vm.StopFaulted:
+			p.State = StateFaulted
+		default:
+			p.State = StateHalted
+		}
+		stopClocks(p.m)
+		close(p.done)
+	default:
+		p.State = StateRunning
+	}
+	info := p.Process
+	var hooks []func(Process)
+	switch info.State {
+	case StateHalted, StateKilled:
+		hooks = s.haltHooks
+	case StateFaulted:
+		hooks = s.faultHooks
+	}
+	s.mu.Unlock()
+	for _, hook := range hooks {
+		hook(info)
+	}
+	// free the ID only once hooks have had a chance to look the VM up
+	if info.State.Ended() {
+		s.mu.Lock()
+		s.dead = append(s.dead, id)
+		s.mu.Unlock()
+	}
+}
+
+// stopClocks disarms the timers of an ended VM's clocks so that they no
+// longer deliver ticks to it.
+func stopClocks(m *vm.VM) {
+	for slot := range 16 {
+		if c, ok := m.Device(slot).(*Clock); ok {
+			c.Stop()
+		}
+	}
+}
+
+// OnSpawn registers a hook called after a VM is spawned, before it starts
+// running.
+func (s *System) OnSpawn(hook func(Process)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spawnHooks = append(s.spawnHooks, hook)
+}
+
+// OnHalt registers a hook called when a VM halts or is killed. The VM can
+// still be found with GetVM while the hook runs.
+func (s *System) OnHalt(hook func(Process)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.haltHooks = append(s.haltHooks, hook)
+}
+
+// OnFault registers a hook called when a VM faults. The VM can still be
+// found with GetVM while the hook runs.
+func (s *System) OnFault(hook func(Process)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faultHooks = append(s.faultHooks, hook)
+}
+
+// Record logs the inputs of every VM spawned from now on to r.
+func (s *System) Record(r *Recorder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recorder = r
+}
+
+// Replay makes every VM spawned from now on replay rec rather than run live.
+// Spawn the same programs with the same options, in the same order, as the
+// recorded run. Each VM ignores live inputs and is given its recorded inputs
+// at the cycles they were recorded at instead, so the VMs end up with the
+// same memory and output however their goroutines are scheduled.
+func (s *System) Replay(rec *Recording) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replay = rec
+}
+
+// WaitReplay waits for every replayed VM to reach the end of its recording.
+// It reports any VM whose execution diverged from the recording.
+func (s *System) WaitReplay() error {
+	s.replaying.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Join(s.replayErr...)
+}
+
+// Kill stops a VM. Its ID is reused by a later Spawn once the VM has
+// stopped.
 func (s *System) Kill(vmID uint8) error {
-	if vm, ok := s.vms[vmID]; ok {
-		vm.Stop()
-		return nil
+	s.mu.Lock()
+	p, ok := s.procs[vmID]
+	if !ok || p.m == nil || p.State.Ended() {
+		s.mu.Unlock()
+		return errors.New("vm not running")
 	}
-	return errors.New("vm not found")
+	p.killed = true
+	s.mu.Unlock()
+
+	p.m.Stop()
+	s.sched.kill(vmID)
+	return nil
 }
 
+// GetVM returns the machine of a process, including one that has ended but
+// whose ID has not been reused yet.
 func (s *System) GetVM(vmID uint8) (*vm.VM, error) {
-	if vm, ok := s.vms[vmID]; ok {
-		return vm, nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.procs[vmID]; ok && p.m != nil {
+		return p.m, nil
 	}
 	return nil, errors.New("vm not found")
 }
+
+// Wait blocks until a VM halts, faults or is killed and returns its final
+// process table entry.
+func (s *System) Wait(vmID uint8) (Process, error) {
+	s.mu.Lock()
+	p, ok := s.procs[vmID]
+	s.mu.Unlock()
+	if !ok {
+		return Process{}, errors.New("vm not found")
+	}
+	<-p.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return p.Process, nil
+}
+
+// List returns the process table in ID order. Ended processes stay listed
+// until their ID is reused.
+func (s *System) List() []Process {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Process, 0, len(s.procs))
+	for _, p := range s.procs {
+		out = append(out, p.Process)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Fault returns the extended fault register of a VM.
+func (s *System) Fault(vmID uint8) (vm.FaultInfo, error) {
+	machine, err := s.GetVM(vmID)
+	if err != nil {
+		return vm.FaultInfo{}, err
+	}
+	return machine.Fault(), nil
+}
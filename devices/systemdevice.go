@@ -0,0 +1,254 @@
+package devices
+
+import (
+	"errors"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+const SystemDeviceType = 0x02
+
+/**
+System Device
+
+Lets a privileged VM, such as a hypervisor, manage the processes of the
+System it runs in. Commands run in the background: busy reads 1 until the
+command completes, when the result registers are set and the device raises
+its interrupt. A command given while busy is ignored and sets result to 2.
+
+Reg  Addr   Name              R/W   Description
+---  ----   ----              ---   -----------
+0    0x00   device_type       R     0x02 = system
+1    0x01   command           W     1 spawn, 2 kill, 3 status, 4 list
+2    0x02   busy              R     1 while a command is running
+3    0x03   result            R     0 ok, or an error code
+4    0x04   vm_id             RW    VM to kill or query; the new VM after spawn
+5    0x05   state             R     process state of vm_id after status
+6    0x06   count             R     processes written by list
+7    0x07   addr_high         W     spawn: program name, list: output buffer
+8    0x08   addr_low          W
+9    0x09   length            W     spawn: name length, list: buffer length
+11   0x0B   callback_high     RW    completion interrupt handler
+12   0x0C   callback_low      RW
+
+Process states are 0 starting, 1 running, 2 waiting, 3 halted, 4 faulted and
+5 killed. List writes an (id, state) byte pair for each process, in ID order,
+for as many as fit in the buffer. Names and buffers end at the end of memory.
+
+Error codes:
+
+1  command unknown
+2  busy, a command is already running
+3  program not found
+4  no capacity for another VM
+5  VM not found or not running
+**/
+
+const (
+	SystemSpawn  = 0x01
+	SystemKill   = 0x02
+	SystemStatus = 0x03
+	SystemList   = 0x04
+)
+
+const (
+	SystemOK byte = iota
+	SystemErrCommand
+	SystemErrBusy
+	SystemErrProgram
+	SystemErrCapacity
+	SystemErrNoVM
+)
+
+type SystemDevice struct {
+	sys     *System
+	vm      *vm.VM
+	load    ProgramLoader
+	options []SpawnOption
+
+	deviceID int
+
+	busy         bool
+	result       byte
+	vmID         byte
+	state        byte
+	count        byte
+	addr         uint16
+	length       byte
+	callbackAddr uint16
+}
+
+// NewSystemDevice returns a system device for vm, registered as device
+// deviceNum, that spawns programs resolved by load and sets them up with
+// options.
+func NewSystemDevice(sys *System, deviceNum int, vm *vm.VM, load ProgramLoader, options ...SpawnOption) *SystemDevice {
+	return &SystemDevice{
+		sys:      sys,
+		vm:       vm,
+		load:     load,
+		options:  options,
+		deviceID: deviceNum,
+	}
+}
+
+func (d *SystemDevice) Write(addr uint16, data byte) {
+	switch addr & 0x000F {
+	case 0x01:
+		d.command(data)
+	case 0x04:
+		d.vmID = data
+	case 0x07:
+		d.addr = (uint16(data) << 8) | (d.addr & 0x00FF)
+	case 0x08:
+		d.addr = (uint16(data)) | (d.addr & 0xFF00)
+	case 0x09:
+		d.length = data
+	case 0x0B:
+		d.callbackAddr = (uint16(data) << 8) | (d.callbackAddr & 0x00FF)
+	case 0x0C:
+		d.callbackAddr = (uint16(data)) | (d.callbackAddr & 0xFF00)
+	}
+}
+
+func (d *SystemDevice) Read(addr uint16) byte {
+	switch addr & 0x000F {
+	case 0x00:
+		return SystemDeviceType
+	case 0x02:
+		if d.busy {
+			return 1
+		}
+		return 0
+	case 0x03:
+		return d.result
+	case 0x04:
+		return d.vmID
+	case 0x05:
+		return d.state
+	case 0x06:
+		return d.count
+	case 0x07:
+		return byte(d.addr >> 8)
+	case 0x08:
+		return byte(d.addr & 0x00FF)
+	case 0x09:
+		return d.length
+	case 0x0B:
+		return byte(d.callbackAddr >> 8)
+	case 0x0C:
+		return byte(d.callbackAddr & 0x00FF)
+	}
+	return 0
+}
+
+// command starts a command on its own goroutine, as spawning and killing
+// wait on other VMs. The result is delivered to the VM as a
+// SystemCompletion.
+func (d *SystemDevice) command(cmd byte) {
+	if d.busy {
+		d.result = SystemErrBusy
+		return
+	}
+	done := SystemCompletion{Slot: d.deviceID, VM: d.vmID, Addr: d.addr}
+	d.busy = true
+	switch cmd {
+	case SystemSpawn:
+		name := string(d.vm.MMIO.ReadData(d.addr, min(int(d.length), 0x10000-int(d.addr))))
+		go func() {
+			program, err := d.load(name)
+			if err != nil {
+				done.Result = SystemErrProgram
+				d.complete(done)
+				return
+			}
+			id, err := d.sys.Spawn(program, d.options...)
+			if err != nil {
+				done.Result = SystemErrCapacity
+			}
+			done.VM = id
+			d.complete(done)
+		}()
+	case SystemKill:
+		go func() {
+			if err := d.sys.Kill(done.VM); err != nil {
+				done.Result = SystemErrNoVM
+			}
+			d.complete(done)
+		}()
+	case SystemStatus:
+		go func() {
+			done.Result = SystemErrNoVM
+			for _, p := range d.sys.List() {
+				if p.ID == done.VM {
+					done.Result, done.State = SystemOK, byte(p.State)
+				}
+			}
+			d.complete(done)
+		}()
+	case SystemList:
+		size := min(int(d.length), 0x10000-int(d.addr)) / 2
+		go func() {
+			list := d.sys.List()
+			for _, p := range list[:min(len(list), size)] {
+				done.Data = append(done.Data, p.ID, byte(p.State))
+			}
+			done.Count = byte(len(done.Data) / 2)
+			d.complete(done)
+		}()
+	default:
+		done.Result = SystemErrCommand
+		d.complete(done)
+	}
+}
+
+func (d *SystemDevice) complete(done SystemCompletion) {
+	d.vm.Deliver(done)
+	d.vm.RaiseInterrupt(d.deviceID)
+}
+
+// SaveState saves the registers. A command still running is not saved, so
+// a restored device is never busy.
+func (d *SystemDevice) SaveState() ([]byte, error) {
+	return []byte{
+		d.result, d.vmID, d.state, d.count,
+		byte(d.addr >> 8), byte(d.addr), d.length,
+		byte(d.callbackAddr >> 8), byte(d.callbackAddr),
+	}, nil
+}
+
+func (d *SystemDevice) LoadState(data []byte) error {
+	if len(data) != 9 {
+		return errors.New("system device: bad state length")
+	}
+	d.busy = false
+	d.result, d.vmID, d.state, d.count = data[0], data[1], data[2], data[3]
+	d.addr = uint16(data[4])<<8 | uint16(data[5])
+	d.length = data[6]
+	d.callbackAddr = uint16(data[7])<<8 | uint16(data[8])
+	return nil
+}
+
+// SystemCompletion is the input applied to a VM when a command it gave the
+// system device in Slot completes.
+type SystemCompletion struct {
+	Slot   int
+	Result byte
+	VM     byte
+	State  byte
+	Count  byte
+	Addr   uint16
+	Data   []byte
+}
+
+func (c SystemCompletion) Apply(m *vm.VM) {
+	d, ok := m.Device(c.Slot).(*SystemDevice)
+	if !ok {
+		return
+	}
+	d.busy = false
+	d.result = c.Result
+	d.vmID = c.VM
+	d.state = c.State
+	d.count = c.Count
+	m.MMIO.WriteData(c.Addr, c.Data[:min(len(c.Data), 0x10000-int(c.Addr))])
+}
@@ -0,0 +1,229 @@
+package devices
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+// hypervisorProgram spawns "wait", queries it, kills it and lists the
+// processes, waiting for the completion interrupt after each command. Results
+// are stored from 0x1000 and the process list at 0x1010.
+const hypervisorProgram = `
+push16 0x030B
+push16 completed
+store16
+
+push16 0x1100
+push16 'wa'
+store16
+push16 0x1102
+push16 'it'
+store16
+push16 0x0307
+push16 0x1100
+store16
+push16 0x0309
+push 4
+store
+push16 0x0301
+push 1
+store
+push16 until_done
+call
+push16 0x1000
+push16 0x0303
+load
+store
+push16 0x1001
+push16 0x0304
+load
+store
+
+push16 0x0301
+push 3
+store
+push16 until_done
+call
+push16 0x1002
+push16 0x0305
+load
+store
+
+push16 0x0301
+push 2
+store
+push16 until_done
+call
+push16 0x1003
+push16 0x0303
+load
+store
+
+push16 0x0301
+push 9
+store
+push16 until_done
+call
+push16 0x1004
+push16 0x0303
+load
+store
+
+push16 0x0307
+push16 0x1010
+store16
+push16 0x0309
+push 16
+store
+push16 0x0301
+push 4
+store
+push16 until_done
+call
+push16 0x1005
+push16 0x0306
+load
+store
+
+// spawn "w", which doesn't exist
+push16 0x0307
+push16 0x1100
+store16
+push16 0x0309
+push 1
+store
+push16 0x0301
+push 1
+store
+push16 until_done
+call
+push16 0x1006
+push16 0x0303
+load
+store
+halt
+
+until_done:
+push16 until_done
+push16 0x1007
+load
+jz
+push16 0x1007
+push 0
+store
+ret
+
+completed:
+push16 0x1007
+push 1
+store
+reti
+`
+
+func TestSystemDevice(t *testing.T) {
+	sys := NewSystem()
+	defer sys.Close()
+	load := func(name string) ([]byte, error) {
+		if name == "wait" {
+			return []byte{vm.YieldInstruction}, nil
+		}
+		return nil, errors.New("not found")
+	}
+
+	id, err := sys.Spawn(assemble(t, hypervisorProgram), func(m *vm.VM) {
+		m.RegisterDevice(0, NewSystemDevice(sys, 0, m, load))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := sys.Wait(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.State != StateHalted {
+		t.Fatalf("hypervisor %v: %v", p.State, p.Exit.Fault)
+	}
+
+	m, _ := sys.GetVM(id)
+	var results, list []byte
+	m.Inspect(func(m *vm.VM) {
+		results = m.MMIO.ReadData(0x1000, 7)
+		list = m.MMIO.ReadData(0x1010, 4)
+	})
+	child := id + 1
+	if results[0] != SystemOK || results[1] != child {
+		t.Errorf("spawn: got result %d, vm %d", results[0], results[1])
+	}
+	if state := ProcessState(results[2]); state != StateRunning && state != StateWaiting {
+		t.Errorf("status: got %v", state)
+	}
+	if results[3] != SystemOK {
+		t.Errorf("kill: got result %d", results[3])
+	}
+	if results[4] != SystemErrCommand {
+		t.Errorf("unknown command: got result %d", results[4])
+	}
+	if results[5] != 2 || list[0] != id || ProcessState(list[1]) != StateRunning || list[2] != child {
+		t.Errorf("list: got %d processes % X", results[5], list)
+	}
+	if results[6] != SystemErrProgram {
+		t.Errorf("spawning a missing program: got result %d", results[6])
+	}
+	if p, _ := sys.Wait(child); p.State != StateKilled {
+		t.Errorf("child is %v, want killed", p.State)
+	}
+}
+
+func TestSystemDeviceEndOfMemory(t *testing.T) {
+	sys := NewSystem()
+	defer sys.Close()
+	for range 2 {
+		if _, err := sys.Spawn([]byte{vm.YieldInstruction}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var names []string
+	load := func(name string) ([]byte, error) {
+		names = append(names, name)
+		return nil, errors.New("not found")
+	}
+	m := vm.New()
+	d := NewSystemDevice(sys, 0, m, load)
+	m.RegisterDevice(0, d)
+
+	// run a command with its buffer at addr and wait for it to complete
+	run := func(cmd byte, addr uint16, length byte) (result, count byte) {
+		m.Inspect(func(m *vm.VM) {
+			m.MMIO.Write(0x0307, byte(addr>>8))
+			m.MMIO.Write(0x0308, byte(addr))
+			m.MMIO.Write(0x0309, length)
+			m.MMIO.Write(0x0301, cmd)
+		})
+		waitFor(t, "the command", func() bool {
+			busy := byte(1)
+			m.Inspect(func(m *vm.VM) {
+				busy, result, count = m.MMIO.Read(0x0302), m.MMIO.Read(0x0303), m.MMIO.Read(0x0306)
+			})
+			return busy == 0
+		})
+		return result, count
+	}
+
+	if result, _ := run(SystemSpawn, 0xFFFF, 4); result != SystemErrProgram || len(names) != 1 || len(names[0]) != 1 {
+		t.Fatalf("spawn: got result %d loading %q", result, names)
+	}
+	if _, count := run(SystemList, 0xFFFD, 16); count != 1 {
+		t.Fatalf("list: got %d processes in 3 bytes", count)
+	}
+
+	var tail []byte
+	m.Inspect(func(m *vm.VM) {
+		SystemCompletion{Slot: 0, Addr: 0xFFFF, Data: []byte{0xAA, 0xBB}}.Apply(m)
+		tail = m.MMIO.ReadData(0xFFFF, 1)
+	})
+	if tail[0] != 0xAA {
+		t.Fatalf("got %02X at the end of memory", tail[0])
+	}
+}
@@ -1,13 +1,19 @@
 package devices
 
 import (
-	"fmt"
+	"errors"
+	"io"
+	"os"
 
 	"github.com/alisdairrankine/frienvironment/vm"
 )
 
 const TerminalDeviceType = 0x05
 
+// TerminalBufferSize is the number of input bytes a terminal holds before
+// further input is dropped.
+const TerminalBufferSize = 256
+
 /**
 Terminal Device
 
@@ -18,44 +24,246 @@ Reg  Addr   Name              R/W   Description
 2    0x02   data_addr_low     W
 3    0x03   data_length       W
 4    0x04   write_trigger     W
+5    0x05   input_control     RW    bit 0 line mode, bit 1 echo, bit 2 interrupt on input
+6    0x06   input_available   R     bytes ready to read, up to 255
+7    0x07   input_data        R     next input byte, 0 if none are ready
+8    0x08   input_status      RW    bit 0 input was dropped as the buffer was full, write 1 to clear
+11   0x0B   callback_high     RW
+12   0x0C   callback_low      RW
 
+In raw mode input bytes are ready as soon as they arrive. In line mode they
+are held until a newline ends the line, and backspace deletes the last byte of
+the line. A line holds up to 255 bytes before its newline; more are dropped.
+The interrupt is raised whenever bytes become ready.
 **/
 
+const (
+	TerminalLineMode  = 0x01
+	TerminalEcho      = 0x02
+	TerminalInterrupt = 0x04
+)
+
 type Terminal struct {
 	vm         *vm.VM
+	deviceID   int
 	DataAddr   uint16
 	DataLength byte
+
+	// Out receives output and echoed input. It defaults to os.Stdout.
+	Out io.Writer
+
+	control      byte
+	dropped      bool
+	callbackAddr uint16
+
+	input [TerminalBufferSize]byte
+	head  int
+	count int
+	line  []byte // the line being typed in line mode
 }
 
-func NewTerminal(vm *vm.VM) *Terminal {
+// NewTerminal returns a terminal for vm, registered as device deviceNum.
+func NewTerminal(vm *vm.VM, deviceNum int) *Terminal {
 	return &Terminal{
-		vm: vm,
+		vm:       vm,
+		deviceID: deviceNum,
+		Out:      os.Stdout,
 	}
 }
 
 func (t *Terminal) Write(addr uint16, data byte) {
-	if addr == 1 {
-		fmt.Print(string(data))
-	}
-
 	switch addr & 0x000F {
-
 	case 0x01:
 		t.DataAddr = (uint16(data) << 8) | (t.DataAddr & 0x00FF)
 	case 0x02:
 		t.DataAddr = (uint16(data)) | (t.DataAddr & 0xFF00)
 	case 0x03:
 		t.DataLength = data
-		fmt.Printf("data length : %d\n", data)
 	case 0x04:
-		data := t.vm.MMIO.ReadData(t.DataAddr, int(t.DataLength))
-		fmt.Println("OUT: ", string(data))
+		t.Out.Write(t.vm.MMIO.ReadData(t.DataAddr, min(int(t.DataLength), 0x10000-int(t.DataAddr))))
+	case 0x05:
+		t.control = data & (TerminalLineMode | TerminalEcho | TerminalInterrupt)
+		if t.control&TerminalLineMode == 0 && len(t.line) > 0 {
+			// leaving line mode makes a partly typed line ready
+			t.push(t.line)
+			t.line = nil
+		}
+	case 0x08:
+		if data&0x01 != 0 {
+			t.dropped = false
+		}
+	case 0x0B:
+		t.callbackAddr = (uint16(data) << 8) | (t.callbackAddr & 0x00FF)
+	case 0x0C:
+		t.callbackAddr = (uint16(data)) | (t.callbackAddr & 0xFF00)
 	}
 }
 
-func (Terminal) Read(addr uint16) byte {
-	if addr == 0 {
-		return 0x05
+func (t *Terminal) Read(addr uint16) byte {
+	switch addr & 0x000F {
+	case 0x00:
+		return TerminalDeviceType
+	case 0x05:
+		return t.control
+	case 0x06:
+		return byte(min(t.count, 255))
+	case 0x07:
+		if t.count == 0 {
+			return 0
+		}
+		b := t.input[t.head]
+		t.head = (t.head + 1) % TerminalBufferSize
+		t.count--
+		return b
+	case 0x08:
+		if t.dropped {
+			return 0x01
+		}
+		return 0
+	case 0x0B:
+		return byte(t.callbackAddr >> 8)
+	case 0x0C:
+		return byte(t.callbackAddr & 0x00FF)
 	}
 	return 0
 }
+
+// Feed delivers input to the terminal. It may be called from any goroutine;
+// the input is applied between the VM's instructions.
+func (t *Terminal) Feed(data []byte) {
+	t.vm.Deliver(TerminalInput{
+		Slot: t.deviceID,
+		Data: append([]byte(nil), data...),
+	})
+}
+
+// SendInput feeds the character typed by a key down, so a terminal can be
+// given input by a Compositor.
+func (t *Terminal) SendInput(ev InputEvent) {
+	if ev.Kind == InputKeyDown && ev.Char != 0 {
+		t.Feed([]byte{ev.Char})
+	}
+}
+
+// Listen feeds everything read from r to the terminal on a new goroutine,
+// until r returns an error.
+func (t *Terminal) Listen(r io.Reader) {
+	go func() {
+		buf := make([]byte, TerminalBufferSize)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				t.Feed(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// push makes data ready to read, dropping what doesn't fit.
+func (t *Terminal) push(data []byte) {
+	for _, b := range data {
+		if t.count == TerminalBufferSize {
+			t.dropped = true
+			return
+		}
+		t.input[(t.head+t.count)%TerminalBufferSize] = b
+		t.count++
+	}
+}
+
+func (t *Terminal) echo(data []byte) {
+	if t.control&TerminalEcho != 0 {
+		t.Out.Write(data)
+	}
+}
+
+// TerminalInput is the input applied to a VM when input arrives at the
+// terminal in Slot.
+type TerminalInput struct {
+	Slot int
+	Data []byte
+}
+
+func (in TerminalInput) Apply(m *vm.VM) {
+	t, ok := m.Device(in.Slot).(*Terminal)
+	if !ok {
+		return
+	}
+	ready := false
+	for _, b := range in.Data {
+		if t.control&TerminalLineMode == 0 {
+			t.push([]byte{b})
+			t.echo([]byte{b})
+			ready = true
+			continue
+		}
+		switch b {
+		case 0x08, 0x7F:
+			if len(t.line) > 0 {
+				t.line = t.line[:len(t.line)-1]
+				t.echo([]byte("\b \b"))
+			}
+			continue
+		case '\r':
+			b = '\n'
+		}
+		// keep room for the newline so that a full line still ends
+		if len(t.line) == TerminalBufferSize-1 && b != '\n' {
+			t.dropped = true
+			continue
+		}
+		t.line = append(t.line, b)
+		t.echo([]byte{b})
+		if b == '\n' {
+			t.push(t.line)
+			t.line = nil
+			ready = true
+		}
+	}
+	if ready && t.control&TerminalInterrupt != 0 {
+		m.RaiseInterrupt(in.Slot)
+	}
+}
+
+// SaveState saves the registers along with any input not yet read.
+func (t *Terminal) SaveState() ([]byte, error) {
+	var flags byte
+	if t.dropped {
+		flags = 0x01
+	}
+	data := []byte{
+		byte(t.DataAddr >> 8), byte(t.DataAddr), t.DataLength,
+		t.control, flags,
+		byte(t.callbackAddr >> 8), byte(t.callbackAddr),
+		byte(t.count >> 8), byte(t.count),
+	}
+	for i := range t.count {
+		data = append(data, t.input[(t.head+i)%TerminalBufferSize])
+	}
+	return append(data, t.line...), nil
+}
+
+func (t *Terminal) LoadState(data []byte) error {
+	if len(data) < 9 {
+		return errors.New("terminal: bad state length")
+	}
+	count := int(data[7])<<8 | int(data[8])
+	rest := data[9:]
+	if count > TerminalBufferSize || count > len(rest) || len(rest)-count >= TerminalBufferSize {
+		return errors.New("terminal: bad state length")
+	}
+	t.DataAddr = uint16(data[0])<<8 | uint16(data[1])
+	t.DataLength = data[2]
+	t.control = data[3]
+	t.dropped = data[4]&0x01 != 0
+	t.callbackAddr = uint16(data[5])<<8 | uint16(data[6])
+	copy(t.input[:], rest[:count])
+	t.head, t.count, t.line = 0, count, nil
+	if len(rest) > count {
+		t.line = append([]byte(nil), rest[count:]...)
+	}
+	return nil
+}
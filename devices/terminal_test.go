@@ -0,0 +1,176 @@
+package devices
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+// inputProgram sets the terminal's input control and copies each byte that
+// becomes ready to 0x1000 onwards, counting them at 0x10FF
+const inputProgram = `
+push16 0x031B
+push16 on_input
+store16
+push16 0x0315
+push %d
+store
+yield
+
+on_input:
+push16 finished
+push16 0x0316
+load
+jz
+push 0x10
+push16 0x10FF
+load
+push16 0x0317
+load
+store
+push16 0x10FF
+push16 0x10FF
+load
+inc
+store
+push16 on_input
+push 1
+jnz
+finished:
+reti
+`
+
+func newTerminalVM(t *testing.T, control byte) (*vm.VM, *Terminal, *bytes.Buffer) {
+	t.Helper()
+	m := vm.New()
+	m.LoadProgram(assemble(t, fmt.Sprintf(inputProgram, control)))
+	term := NewTerminal(m, 1)
+	out := &bytes.Buffer{}
+	term.Out = out
+	m.RegisterDevice(1, term)
+	if stop := m.RunSync(context.Background()); stop.Reason != vm.StopWaiting {
+		t.Fatalf("got %v, want waiting", stop.Reason)
+	}
+	m.Run()
+	t.Cleanup(m.Stop)
+	return m, term, out
+}
+
+func typed(m *vm.VM) string {
+	var got []byte
+	m.Inspect(func(m *vm.VM) {
+		got = m.MMIO.ReadData(0x1000, int(m.MMIO.Read(0x10FF)))
+	})
+	return string(got)
+}
+
+func TestTerminalRawInput(t *testing.T) {
+	m, term, out := newTerminalVM(t, TerminalInterrupt)
+	term.Listen(strings.NewReader("hi"))
+	waitFor(t, "input", func() bool { return typed(m) == "hi" })
+	term.Feed([]byte("\x7f!"))
+	waitFor(t, "more input", func() bool { return typed(m) == "hi\x7f!" })
+	m.Inspect(func(*vm.VM) {
+		if out.Len() != 0 {
+			t.Errorf("echoed %q with echo off", out)
+		}
+	})
+}
+
+func TestTerminalLineInput(t *testing.T) {
+	m, term, out := newTerminalVM(t, TerminalLineMode|TerminalEcho|TerminalInterrupt)
+	term.Feed([]byte("ab\x7fc"))
+	m.Inspect(func(m *vm.VM) {
+		if n := m.MMIO.Read(0x0316); n != 0 {
+			t.Errorf("%d bytes ready before the line ended", n)
+		}
+	})
+	term.Feed([]byte("\r"))
+	waitFor(t, "a line", func() bool { return typed(m) == "ac\n" })
+	m.Inspect(func(*vm.VM) {
+		if got := out.String(); got != "ab\b \bc\n" {
+			t.Errorf("echoed %q", got)
+		}
+	})
+}
+
+func TestTerminalInputOverflow(t *testing.T) {
+	m := vm.New()
+	term := NewTerminal(m, 1)
+	m.RegisterDevice(1, term)
+	term.Feed(bytes.Repeat([]byte{'x'}, TerminalBufferSize+10))
+
+	var available, status byte
+	m.Inspect(func(m *vm.VM) {
+		available, status = m.MMIO.Read(0x0316), m.MMIO.Read(0x0318)
+	})
+	if available != 255 || status != 0x01 {
+		t.Fatalf("got %d available and status %02X, want 255 and dropped", available, status)
+	}
+
+	state, _ := term.SaveState()
+	restored := NewTerminal(m, 1)
+	if err := restored.LoadState(state); err != nil {
+		t.Fatal(err)
+	}
+	if restored.count != TerminalBufferSize || !restored.dropped {
+		t.Fatalf("restored %d bytes, dropped %v", restored.count, restored.dropped)
+	}
+	restored.Write(0x08, 0x01)
+	if restored.Read(0x08) != 0 {
+		t.Fatal("dropped flag not cleared")
+	}
+	if err := restored.LoadState(state[:3]); err == nil {
+		t.Fatal("expected an error loading the registers alone")
+	}
+}
+
+func TestTerminalLineOverflow(t *testing.T) {
+	m := vm.New()
+	term := NewTerminal(m, 1)
+	m.RegisterDevice(1, term)
+	m.Inspect(func(m *vm.VM) {
+		m.MMIO.Write(0x0315, TerminalLineMode)
+	})
+	term.Feed(bytes.Repeat([]byte{'x'}, TerminalBufferSize+10))
+	term.Feed([]byte("\n"))
+
+	var line []byte
+	m.Inspect(func(m *vm.VM) {
+		for m.MMIO.Read(0x0316) > 0 {
+			line = append(line, m.MMIO.Read(0x0317))
+		}
+	})
+	want := append(bytes.Repeat([]byte{'x'}, TerminalBufferSize-1), '\n')
+	if !bytes.Equal(line, want) || term.Read(0x08) != 0x01 {
+		t.Fatalf("got %q, dropped %02X", line, term.Read(0x08))
+	}
+}
+
+func TestTerminalOutput(t *testing.T) {
+	m := vm.New()
+	term := NewTerminal(m, 1)
+	out := &bytes.Buffer{}
+	term.Out = out
+	m.RegisterDevice(1, term)
+
+	write := func(addr uint16, data string, length byte) {
+		m.Inspect(func(m *vm.VM) {
+			m.MMIO.WriteData(addr, []byte(data))
+			m.MMIO.Write(0x0311, byte(addr>>8))
+			m.MMIO.Write(0x0312, byte(addr))
+			m.MMIO.Write(0x0313, length)
+			m.MMIO.Write(0x0314, 1)
+		})
+	}
+	write(0x1000, "hello\n", 6)
+	// output at the end of memory stops there
+	write(0xFFFE, "ok", 8)
+	if got := out.String(); got != "hello\nok" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,113 @@
+package disassembler
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+// Instruction is a single decoded instruction.
+type Instruction struct {
+	Addr    uint16
+	Bytes   []byte
+	Opcode  byte
+	Operand uint16
+
+	// Valid is false when the opcode is unknown or its operand runs past
+	// the end of the input. Bytes then holds whatever was available.
+	Valid bool
+}
+
+func (i Instruction) Name() string {
+	if name, ok := vm.InstrName[i.Opcode]; ok && i.Valid {
+		return name
+	}
+	return "???"
+}
+
+func (i Instruction) HasOperand() bool {
+	return vm.InstrImmediate[i.Opcode] > 0
+}
+
+// String renders the instruction as "Mnemonic operand".
+func (i Instruction) String() string {
+	if !i.Valid {
+		return fmt.Sprintf("??? 0x%02X", i.Opcode)
+	}
+	switch vm.InstrImmediate[i.Opcode] {
+	case 1:
+		return fmt.Sprintf("%s 0x%02X", i.Name(), i.Operand)
+	case 2:
+		return fmt.Sprintf("%s 0x%04X", i.Name(), i.Operand)
+	}
+	return i.Name()
+}
+
+// DecodeAt decodes the instruction starting at code[offset], reporting it at
+// address addr.
+func DecodeAt(code []byte, offset int, addr uint16) Instruction {
+	op := code[offset]
+	instr := Instruction{Addr: addr, Opcode: op}
+	if _, ok := vm.InstrName[op]; !ok {
+		instr.Bytes = code[offset : offset+1]
+		return instr
+	}
+	size := vm.InstrImmediate[op]
+	if offset+1+size > len(code) {
+		instr.Bytes = code[offset:]
+		return instr
+	}
+	instr.Bytes = code[offset : offset+1+size]
+	for _, b := range instr.Bytes[1:] {
+		instr.Operand = instr.Operand<<8 | uint16(b)
+	}
+	instr.Valid = true
+	return instr
+}
+
+// Decode decodes code as though it were loaded at origin.
+func Decode(code []byte, origin uint16) []Instruction {
+	var out []Instruction
+	for offset := 0; offset < len(code); {
+		instr := DecodeAt(code, offset, origin+uint16(offset))
+		out = append(out, instr)
+		offset += len(instr.Bytes)
+	}
+	return out
+}
+
+// Listing writes one line per instruction with its address, raw bytes and
+// mnemonic.
+func Listing(w io.Writer, code []byte, origin uint16) error {
+	for _, instr := range Decode(code, origin) {
+		if _, err := fmt.Fprintln(w, FormatLine(instr)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FormatLine renders a single listing line.
+func FormatLine(instr Instruction) string {
+	raw := make([]string, len(instr.Bytes))
+	for i, b := range instr.Bytes {
+		raw[i] = fmt.Sprintf("%02X", b)
+	}
+	return fmt.Sprintf("%04X  %-9s %s", instr.Addr, strings.Join(raw, " "), instr)
+}
+
+// Source renders code as assembler source that assembles back to the same
+// bytes. It fails if code contains unknown opcodes or a truncated operand.
+func Source(code []byte) (string, error) {
+	var sb strings.Builder
+	for _, instr := range Decode(code, vm.AddrProgramStart) {
+		if !instr.Valid {
+			return "", fmt.Errorf("cannot disassemble 0x%02X at 0x%04X", instr.Opcode, instr.Addr)
+		}
+		sb.WriteString(strings.ToLower(instr.String()))
+		sb.WriteByte('\n')
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,61 @@
+package disassembler
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/alisdairrankine/frienvironment/assembler"
+	"github.com/alisdairrankine/frienvironment/vm"
+)
+
+func TestRoundTrip(t *testing.T) {
+	ops := []byte{}
+	for op := range vm.InstrName {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i] < ops[j] })
+
+	code := []byte{}
+	for _, op := range ops {
+		code = append(code, op)
+		for i := 0; i < vm.InstrImmediate[op]; i++ {
+			code = append(code, 0xA0+byte(i))
+		}
+	}
+
+	src, err := Source(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := assembler.Assemble(src)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, src)
+	}
+	if !bytes.Equal(out, code) {
+		t.Fatalf("round trip mismatch\ngot  % X\nwant % X", out, code)
+	}
+}
+
+func TestListing(t *testing.T) {
+	var buf bytes.Buffer
+	code := []byte{vm.Push16Instruction, 0xF0, 0x00, vm.PushInstruction, 'P', vm.StoreInstruction, 0x0C, vm.Push16Instruction, 0x01}
+	if err := Listing(&buf, code, vm.AddrProgramStart); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"0400  51 F0 00  Push16 0xF000",
+		"0403  50 50     Push 0x50",
+		"0405  52        Store",
+		"0406  0C        ??? 0x0C",
+		"0407  51 01     ??? 0x51",
+	}
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if _, err := Source(code); err == nil {
+		t.Fatal("expected error disassembling unknown opcode")
+	}
+}
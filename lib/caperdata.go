@@ -1,5 +1,11 @@
 package lib
 
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
 type U8 byte
 type U16 uint16
 type Bool bool
@@ -23,7 +29,292 @@ const (
 	IdentifierList        = 0x08 // (identifier,indentifier, length, data)
 )
 
-func ParseCaperData(raw []byte) any {
+// Lengths are a single byte on the wire, so strings, structs and lists hold
+// at most MaxLength bytes, fields or elements.
+const MaxLength = 0xFF
+
+var (
+	ErrTruncated         = errors.New("truncated input")
+	ErrUnknownIdentifier = errors.New("unknown identifier")
+	ErrMalformed         = errors.New("malformed input")
+	ErrTrailingData      = errors.New("trailing data after value")
+	ErrUnsupportedType   = errors.New("unsupported type")
+	ErrTooLong           = errors.New("value too long")
+)
+
+// DecodeError reports where in the input decoding failed.
+type DecodeError struct {
+	Offset     int
+	Identifier byte
+	Err        error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("caperdata: offset %d (identifier 0x%02X): %v", e.Offset, e.Identifier, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// EncodeError reports the value that could not be encoded.
+type EncodeError struct {
+	Value any
+	Err   error
+}
+
+func (e *EncodeError) Error() string {
+	return fmt.Sprintf("caperdata: cannot encode %T: %v", e.Value, e.Err)
+}
+
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
+
+// EncodeCaperData encodes nil, Bool, bool, U8, U16, CapString, CapStruct and
+// List values. Struct fields are written in key order.
+func EncodeCaperData(v any) ([]byte, error) {
+	return appendValue(nil, v)
+}
+
+// ParseCaperData decodes exactly one value from raw.
+func ParseCaperData(raw []byte) (any, error) {
+	d := decoder{raw: raw}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.off != len(raw) {
+		return nil, &DecodeError{Offset: d.off, Identifier: raw[d.off], Err: ErrTrailingData}
+	}
+	return v, nil
+}
+
+func appendValue(out []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(out, IdentifierNil), nil
+	case bool:
+		return appendValue(out, Bool(v))
+	case Bool:
+		if v {
+			return append(out, IdentifierTrue), nil
+		}
+		return append(out, IdentifierFalse), nil
+	case U8:
+		return append(out, IdentifierU8, byte(v)), nil
+	case U16:
+		return append(out, IdentifierU16, byte(v>>8), byte(v)), nil
+	case CapString:
+		return appendString(append(out, IdentifierString), v)
+	case CapStruct:
+		if len(v) > MaxLength {
+			return nil, &EncodeError{Value: v, Err: ErrTooLong}
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out = append(out, IdentifierStruct, byte(len(keys)))
+		var err error
+		for _, k := range keys {
+			if out, err = appendString(append(out, IdentifierStructField), CapString(k)); err != nil {
+				return nil, err
+			}
+			if out, err = appendValue(out, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case List[U8]:
+		return appendList(out, IdentifierU8, v)
+	case List[U16]:
+		return appendList(out, IdentifierU16, v)
+	case List[CapString]:
+		return appendList(out, IdentifierString, v)
+	}
+	return nil, &EncodeError{Value: v, Err: ErrUnsupportedType}
+}
+
+func appendString(out []byte, s CapString) ([]byte, error) {
+	if len(s) > MaxLength {
+		return nil, &EncodeError{Value: s, Err: ErrTooLong}
+	}
+	out = append(out, byte(len(s)))
+	return append(out, s...), nil
+}
+
+func appendList[T CapPrimitive](out []byte, id byte, list List[T]) ([]byte, error) {
+	if len(list) > MaxLength {
+		return nil, &EncodeError{Value: list, Err: ErrTooLong}
+	}
+	out = append(out, IdentifierList, id, byte(len(list)))
+	for _, item := range list {
+		switch item := any(item).(type) {
+		case U8:
+			out = append(out, byte(item))
+		case U16:
+			out = append(out, byte(item>>8), byte(item))
+		case CapString:
+			var err error
+			if out, err = appendString(out, item); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
+type decoder struct {
+	raw []byte
+	off int
+	id  byte
+}
+
+func (d *decoder) fail(err error) error {
+	return &DecodeError{Offset: d.off, Identifier: d.id, Err: err}
+}
+
+func (d *decoder) take(n int) ([]byte, error) {
+	if d.off+n > len(d.raw) {
+		return nil, d.fail(ErrTruncated)
+	}
+	b := d.raw[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+func (d *decoder) readByte() (byte, error) {
+	b, err := d.take(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *decoder) readU16() (U16, error) {
+	b, err := d.take(2)
+	if err != nil {
+		return 0, err
+	}
+	return U16(b[0])<<8 | U16(b[1]), nil
+}
+
+func (d *decoder) readString() (CapString, error) {
+	n, err := d.readByte()
+	if err != nil {
+		return "", err
+	}
+	b, err := d.take(int(n))
+	if err != nil {
+		return "", err
+	}
+	return CapString(b), nil
+}
+
+func (d *decoder) value() (any, error) {
+	id, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	d.id = id
+	switch id {
+	case IdentifierNil:
+		return nil, nil
+	case IdentifierTrue:
+		return Bool(true), nil
+	case IdentifierFalse:
+		return Bool(false), nil
+	case IdentifierU8:
+		b, err := d.readByte()
+		return U8(b), err
+	case IdentifierU16:
+		return d.readU16()
+	case IdentifierString:
+		return d.readString()
+	case IdentifierStruct:
+		return d.structure()
+	case IdentifierList:
+		return d.list()
+	case IdentifierStructField:
+		d.off--
+		return nil, d.fail(ErrMalformed)
+	}
+	d.off--
+	return nil, d.fail(ErrUnknownIdentifier)
+}
+
+func (d *decoder) structure() (CapStruct, error) {
+	n, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	out := make(CapStruct, n)
+	for range int(n) {
+		d.id = IdentifierStructField
+		id, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if id != IdentifierStructField {
+			d.off--
+			return nil, d.fail(ErrMalformed)
+		}
+		name, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := out[string(name)]; ok {
+			return nil, d.fail(ErrMalformed)
+		}
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		out[string(name)] = v
+	}
+	return out, nil
+}
 
-	return nil
+func (d *decoder) list() (any, error) {
+	elem, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	n, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch elem {
+	case IdentifierU8:
+		b, err := d.take(int(n))
+		if err != nil {
+			return nil, err
+		}
+		out := make(List[U8], n)
+		for i := range b {
+			out[i] = U8(b[i])
+		}
+		return out, nil
+	case IdentifierU16:
+		out := make(List[U16], n)
+		for i := range out {
+			if out[i], err = d.readU16(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case IdentifierString:
+		out := make(List[CapString], n)
+		for i := range out {
+			if out[i], err = d.readString(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	d.off -= 2
+	d.id = elem
+	return nil, d.fail(ErrUnknownIdentifier)
 }
@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCaperDataRoundTrip(t *testing.T) {
+	values := []any{
+		nil,
+		Bool(true),
+		Bool(false),
+		U8(0x7F),
+		U16(0xBEEF),
+		CapString("Ping!"),
+		List[U8]{1, 2, 3},
+		List[U16]{0x0102, 0xFFFF},
+		List[CapString]{"a", "", "bc"},
+		CapStruct{
+			"name":  CapString("receiver"),
+			"id":    U8(3),
+			"tags":  List[CapString]{"x"},
+			"inner": CapStruct{"ok": Bool(true)},
+		},
+	}
+	for _, v := range values {
+		raw, err := EncodeCaperData(v)
+		if err != nil {
+			t.Fatalf("encode %#v: %v", v, err)
+		}
+		got, err := ParseCaperData(raw)
+		if err != nil {
+			t.Fatalf("decode %#v (% X): %v", v, raw, err)
+		}
+		if !reflect.DeepEqual(got, v) {
+			t.Errorf("round trip: got %#v, want %#v", got, v)
+		}
+	}
+}
+
+func TestCaperDataWireFormat(t *testing.T) {
+	raw, err := EncodeCaperData(CapStruct{"b": U16(0x0102), "a": CapString("hi")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		IdentifierStruct, 2,
+		IdentifierStructField, 1, 'a', IdentifierString, 2, 'h', 'i',
+		IdentifierStructField, 1, 'b', IdentifierU16, 0x01, 0x02,
+	}
+	if !bytes.Equal(raw, want) {
+		t.Fatalf("got % X, want % X", raw, want)
+	}
+}
+
+func TestCaperDataErrors(t *testing.T) {
+	cases := []struct {
+		raw    []byte
+		err    error
+		offset int
+	}{
+		{[]byte{}, ErrTruncated, 0},
+		{[]byte{IdentifierU16, 0x01}, ErrTruncated, 1},
+		{[]byte{IdentifierString, 5, 'a'}, ErrTruncated, 2},
+		{[]byte{0x42}, ErrUnknownIdentifier, 0},
+		{[]byte{IdentifierList, 0x42, 0}, ErrUnknownIdentifier, 1},
+		{[]byte{IdentifierStruct, 1, IdentifierU8, 1}, ErrMalformed, 2},
+		{[]byte{IdentifierStructField, 1, 'a', 0}, ErrMalformed, 0},
+		{[]byte{IdentifierU8, 1, 2}, ErrTrailingData, 2},
+	}
+	for _, c := range cases {
+		_, err := ParseCaperData(c.raw)
+		var de *DecodeError
+		if !errors.As(err, &de) || !errors.Is(err, c.err) {
+			t.Errorf("% X: got %v, want %v", c.raw, err, c.err)
+			continue
+		}
+		if de.Offset != c.offset {
+			t.Errorf("% X: got offset %d, want %d", c.raw, de.Offset, c.offset)
+		}
+	}
+
+	if _, err := EncodeCaperData(3.5); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("got %v, want ErrUnsupportedType", err)
+	}
+	if _, err := EncodeCaperData(CapString(make([]byte, 256))); !errors.Is(err, ErrTooLong) {
+		t.Errorf("got %v, want ErrTooLong", err)
+	}
+}
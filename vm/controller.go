@@ -0,0 +1,224 @@
+package vm
+
+import (
+	"errors"
+	"math/bits"
+)
+
+const InterruptControllerDeviceType = 0x06
+
+// DeviceCallbackRegister is the device register holding the high byte of a
+// device's interrupt callback when no interrupt controller is registered.
+const DeviceCallbackRegister = 0x0B
+
+/**
+Interrupt Controller
+
+Every device slot has an interrupt line. Lower slots have higher priority: a
+handler is only interrupted by a device in a lower slot.
+
+Reg  Addr   Name              R/W   Description
+---  ----   ----              ---   -----------
+0    0x00   device_type       R     0x06 = interrupt controller
+1    0x01   control           RW    bit 0 set = interrupts enabled
+2    0x02   mask_high         RW    mask bits for slots 15-8, set = masked
+3    0x03   mask_low          RW    mask bits for slots 7-0
+4    0x04   pending_high      RW    raised lines for slots 15-8, write 1 to clear
+5    0x05   pending_low       RW    raised lines for slots 7-0, write 1 to clear
+6    0x06   in_service_high   R     lines whose handler is running, slots 15-8
+7    0x07   in_service_low    R     lines whose handler is running, slots 7-0
+8    0x08   source            R     slot of the running handler, 0xFF if none
+9    0x09   vectors_high      RW    high byte of vector table address
+10   0x0A   vectors_low       RW    low byte of vector table address
+
+The vector table holds 16 big endian handler addresses, one per slot.
+**/
+
+type InterruptController struct {
+	vm *VM
+
+	enabled   bool
+	mask      uint16
+	inService uint16
+	vectors   uint16
+
+	// pending is guarded by vm.qmu as lines are raised from any goroutine
+	pending uint16
+}
+
+// NewInterruptController returns a disabled controller with every line
+// unmasked. It takes over interrupt delivery once registered with a VM.
+func NewInterruptController() *InterruptController {
+	return &InterruptController{}
+}
+
+func (c *InterruptController) Write(addr uint16, data byte) {
+	switch addr & 0x000F {
+	case 0x01:
+		c.enabled = data&0x01 != 0
+		c.recheck()
+	case 0x02:
+		c.mask = (uint16(data) << 8) | (c.mask & 0x00FF)
+		c.recheck()
+	case 0x03:
+		c.mask = (uint16(data)) | (c.mask & 0xFF00)
+		c.recheck()
+	case 0x04:
+		c.clear(uint16(data) << 8)
+	case 0x05:
+		c.clear(uint16(data))
+	case 0x09:
+		c.vectors = (uint16(data) << 8) | (c.vectors & 0x00FF)
+	case 0x0A:
+		c.vectors = (uint16(data)) | (c.vectors & 0xFF00)
+	}
+}
+
+func (c *InterruptController) Read(addr uint16) byte {
+	switch addr & 0x000F {
+	case 0x00:
+		return InterruptControllerDeviceType
+	case 0x01:
+		if c.enabled {
+			return 0x01
+		}
+		return 0x00
+	case 0x02:
+		return byte(c.mask >> 8)
+	case 0x03:
+		return byte(c.mask & 0x00FF)
+	case 0x04:
+		return byte(c.Pending() >> 8)
+	case 0x05:
+		return byte(c.Pending() & 0x00FF)
+	case 0x06:
+		return byte(c.inService >> 8)
+	case 0x07:
+		return byte(c.inService & 0x00FF)
+	case 0x08:
+		return c.source()
+	case 0x09:
+		return byte(c.vectors >> 8)
+	case 0x0A:
+		return byte(c.vectors & 0x00FF)
+	}
+	return 0
+}
+
+func (c *InterruptController) SaveState() ([]byte, error) {
+	var control byte
+	if c.enabled {
+		control = 0x01
+	}
+	pending := c.Pending()
+	return []byte{
+		control,
+		byte(c.mask >> 8), byte(c.mask),
+		byte(pending >> 8), byte(pending),
+		byte(c.inService >> 8), byte(c.inService),
+		byte(c.vectors >> 8), byte(c.vectors),
+	}, nil
+}
+
+func (c *InterruptController) LoadState(data []byte) error {
+	if len(data) != 9 {
+		return errors.New("interrupt controller: bad state length")
+	}
+	c.enabled = data[0]&0x01 != 0
+	c.mask = uint16(data[1])<<8 | uint16(data[2])
+	c.inService = uint16(data[5])<<8 | uint16(data[6])
+	c.vectors = uint16(data[7])<<8 | uint16(data[8])
+	if c.vm != nil {
+		c.vm.qmu.Lock()
+		c.pending = uint16(data[3])<<8 | uint16(data[4])
+		c.vm.qmu.Unlock()
+		c.recheck()
+	}
+	return nil
+}
+
+// ready reports whether a pending line may pre-empt the running handler, if
+// any: it must be enabled, unmasked and of higher priority than any line in
+// service. It must be called with vm.qmu held.
+func (c *InterruptController) ready() bool {
+	lines := c.pending &^ c.mask
+	if !c.enabled || lines == 0 {
+		return false
+	}
+	return c.inService == 0 || bits.TrailingZeros16(lines) < bits.TrailingZeros16(c.inService)
+}
+
+// recheck has the VM look for interrupts again if enabling or unmasking a
+// line, or retiring a handler, has made one ready.
+func (c *InterruptController) recheck() {
+	if c.vm == nil {
+		return
+	}
+	c.vm.qmu.Lock()
+	if c.ready() {
+		c.vm.interrupted.Store(true)
+	}
+	c.vm.qmu.Unlock()
+}
+
+// Pending returns the lines that have been raised but not yet serviced, one
+// bit per slot.
+func (c *InterruptController) Pending() uint16 {
+	if c.vm == nil {
+		return 0
+	}
+	c.vm.qmu.Lock()
+	defer c.vm.qmu.Unlock()
+	return c.pending
+}
+
+func (c *InterruptController) clear(lines uint16) {
+	if c.vm == nil {
+		return
+	}
+	c.vm.qmu.Lock()
+	c.pending &^= lines
+	c.vm.qmu.Unlock()
+}
+
+func (c *InterruptController) source() byte {
+	if c.inService == 0 {
+		return 0xFF
+	}
+	return byte(bits.TrailingZeros16(c.inService))
+}
+
+// next takes the highest priority line that may pre-empt the running
+// handler, if any. It must be called with vm.qmu held.
+func (c *InterruptController) next() (int, bool) {
+	if !c.ready() {
+		return 0, false
+	}
+	slot := bits.TrailingZeros16(c.pending &^ c.mask)
+	c.pending &^= 1 << slot
+	return slot, true
+}
+
+func (c *InterruptController) enter(slot int) uint16 {
+	c.inService |= 1 << slot
+	return c.vectors + uint16(slot)*2
+}
+
+// endOfInterrupt retires the highest priority handler, called on RETI.
+func (c *InterruptController) endOfInterrupt() {
+	c.inService &= c.inService - 1
+	c.recheck()
+}
+
+// RaiseInterrupt raises the interrupt line of the device in slot. With an
+// interrupt controller registered the line is prioritised, masked and
+// vectored by the controller; otherwise the handler address is read from the
+// device's callback registers at DeviceCallbackRegister. It may be called
+// from any goroutine.
+func (vm *VM) RaiseInterrupt(slot int) error {
+	if vm.controller == nil {
+		return vm.Interrupt(0x0300 | uint16(slot)<<4 | DeviceCallbackRegister)
+	}
+	vm.Deliver(LineInput{Slot: slot})
+	return nil
+}
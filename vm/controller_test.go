@@ -0,0 +1,143 @@
+package vm
+
+import "testing"
+
+const (
+	controllerSlot = 2
+	vectorTable    = 0x3000
+	ctrl           = 0x0300 | controllerSlot<<4
+)
+
+// handler stores mark at 0x1000+slot and the source register at 0x1010+slot
+func handler(slot, mark byte) []byte {
+	return []byte{
+		Push16Instruction, 0x10, slot,
+		PushInstruction, mark,
+		StoreInstruction,
+		Push16Instruction, 0x10, 0x10 + slot,
+		Push16Instruction, byte(ctrl >> 8), byte((ctrl | 0x08) & 0xFF),
+		LoadInstruction,
+		StoreInstruction,
+		RetiInstruction,
+	}
+}
+
+func newControllerVM(t *testing.T, program []byte) *VM {
+	t.Helper()
+	m := New()
+	m.LoadProgram(program)
+	m.RegisterDevice(controllerSlot, NewInterruptController())
+	for slot, addr := range map[byte]uint16{1: 0x0500, 5: 0x0600, 7: 0x0700} {
+		m.MMIO.WriteData(addr, handler(slot, 0xA0+slot))
+		m.MMIO.WriteData(vectorTable+uint16(slot)*2, []byte{byte(addr >> 8), byte(addr)})
+	}
+	m.MMIO.Write(ctrl|0x09, vectorTable>>8)
+	m.MMIO.Write(ctrl|0x0A, vectorTable&0xFF)
+	m.MMIO.Write(ctrl|0x01, 0x01)
+	return m
+}
+
+func peek(m *VM, addr uint16) byte {
+	var b byte
+	m.Inspect(func(m *VM) { b = m.MMIO.peek(addr) })
+	return b
+}
+
+func TestControllerPriority(t *testing.T) {
+	m := newControllerVM(t, []byte{YieldInstruction})
+	m.RaiseInterrupt(5)
+	m.RaiseInterrupt(1)
+
+	stop := m.Step()
+	if stop.State.PC != 0x0503 {
+		t.Fatalf("got PC %04X, want slot 1 handler first", stop.State.PC)
+	}
+	if src := m.MMIO.Read(ctrl | 0x08); src != 1 {
+		t.Fatalf("source = %d, want 1", src)
+	}
+
+	if stop := m.RunFor(100); stop.Reason != StopWaiting {
+		t.Fatalf("got %v, want waiting", stop.Reason)
+	}
+	for slot, want := range map[uint16]byte{1: 0xA1, 5: 0xA5, 0x11: 1, 0x15: 5} {
+		if got := peek(m, 0x1000+slot); got != want {
+			t.Errorf("0x%04X = %02X, want %02X", 0x1000+slot, got, want)
+		}
+	}
+	if src := m.MMIO.Read(ctrl | 0x08); src != 0xFF {
+		t.Fatalf("source = %02X after all handlers returned, want FF", src)
+	}
+}
+
+func TestControllerNesting(t *testing.T) {
+	m := newControllerVM(t, []byte{YieldInstruction})
+	m.RaiseInterrupt(5)
+	m.Step()
+
+	// a lower priority line waits for the running handler
+	m.RaiseInterrupt(7)
+	if stop := m.Step(); stop.State.PC < 0x0600 || stop.State.PC >= 0x0700 {
+		t.Fatalf("slot 7 pre-empted slot 5, PC %04X", stop.State.PC)
+	}
+	if m.interrupted.Load() {
+		t.Fatal("still looking for interrupts with only a lower priority line pending")
+	}
+
+	// a higher priority line pre-empts it
+	m.RaiseInterrupt(1)
+	stop := m.Step()
+	if stop.State.PC != 0x0503 || len(stop.State.ReturnStack) != 4 {
+		t.Fatalf("got PC %04X return stack % X, want nested slot 1 handler", stop.State.PC, stop.State.ReturnStack)
+	}
+	if got := m.MMIO.Read(ctrl | 0x07); got != 1<<1|1<<5 {
+		t.Fatalf("in service = %08b", got)
+	}
+
+	m.RunFor(100)
+	if got := peek(m, 0x1017); got != 7 {
+		t.Fatalf("slot 7 handler saw source %d after the others returned", got)
+	}
+}
+
+func TestControllerMask(t *testing.T) {
+	m := newControllerVM(t, []byte{YieldInstruction})
+	m.MMIO.Write(ctrl|0x03, 1<<1)
+	m.RaiseInterrupt(1)
+
+	if stop := m.RunFor(10); stop.Reason != StopWaiting || stop.State.PC != 0x0400 {
+		t.Fatalf("masked line delivered: %v at %04X", stop.Reason, stop.State.PC)
+	}
+	if got := m.MMIO.Read(ctrl | 0x05); got != 1<<1 {
+		t.Fatalf("pending = %08b, want line 1", got)
+	}
+	if m.interrupted.Load() {
+		t.Fatal("still looking for interrupts with only a masked line pending")
+	}
+
+	m.MMIO.Write(ctrl|0x03, 0)
+	m.RunFor(100)
+	if got := peek(m, 0x1001); got != 0xA1 {
+		t.Fatal("unmasked line was not delivered")
+	}
+}
+
+func TestControllerDisabled(t *testing.T) {
+	m := newControllerVM(t, []byte{YieldInstruction})
+	m.MMIO.Write(ctrl|0x01, 0)
+	m.RaiseInterrupt(1)
+	m.RunFor(10)
+	if got := peek(m, 0x1001); got != 0 {
+		t.Fatal("interrupt delivered while the controller was disabled")
+	}
+	if m.interrupted.Load() {
+		t.Fatal("still looking for interrupts with the controller disabled")
+	}
+
+	// writing 1 clears the pending line
+	m.MMIO.Write(ctrl|0x05, 1<<1)
+	m.MMIO.Write(ctrl|0x01, 1)
+	m.RunFor(10)
+	if got := peek(m, 0x1001); got != 0 {
+		t.Fatal("cleared line was delivered")
+	}
+}
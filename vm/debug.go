@@ -0,0 +1,284 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+var FlagName = map[byte]string{
+	FlagFault:                "fault",
+	FlagWaiting:              "waiting",
+	FlagStackOverflow:        "stack overflow",
+	FlagStackUnderflow:       "stack underflow",
+	FlagReturnStackOverflow:  "return stack overflow",
+	FlagReturnStackUnderflow: "return stack underflow",
+	FlagDivideByZero:         "divide by zero",
+	FlagInterruptOverflow:    "interrupt overflow",
+}
+
+// State is a copy of the machine registers taken when execution pauses.
+type State struct {
+	PC          uint16
+	Status      byte
+	Stack       []byte
+	ReturnStack []byte
+	Cycles      uint64
+	Fault       FaultInfo // set when the fault flag is
+}
+
+// Flags returns the names of the status flags that are set, lowest bit first.
+func (s State) Flags() []string {
+	var out []string
+	for bit := 0; bit < 8; bit++ {
+		flag := byte(1) << bit
+		if s.Status&flag == 0 {
+			continue
+		}
+		if name, ok := FlagName[flag]; ok {
+			out = append(out, name)
+		} else {
+			out = append(out, fmt.Sprintf("bit %d", bit))
+		}
+	}
+	return out
+}
+
+// ReturnAddresses decodes the return stack into 16 bit entries, bottom first.
+func (s State) ReturnAddresses() []uint16 {
+	out := make([]uint16, 0, len(s.ReturnStack)/2)
+	for i := 0; i+1 < len(s.ReturnStack); i += 2 {
+		out = append(out, binary.BigEndian.Uint16(s.ReturnStack[i:]))
+	}
+	return out
+}
+
+type StopReason int
+
+const (
+	StopStep StopReason = iota
+	StopBreakpoint
+	StopWatchpoint
+	StopWaiting
+	StopHalted
+	StopFaulted
+	StopBudget
+	StopCancelled
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopStep:
+		return "step"
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopWatchpoint:
+		return "watchpoint"
+	case StopWaiting:
+		return "waiting"
+	case StopHalted:
+		return "halted"
+	case StopFaulted:
+		return "faulted"
+	case StopBudget:
+		return "cycle budget exhausted"
+	case StopCancelled:
+		return "cancelled"
+	}
+	return fmt.Sprintf("StopReason(%d)", int(r))
+}
+
+// Stop reports why execution paused and the state of the machine at that point.
+type Stop struct {
+	Reason StopReason
+	State  State
+	Watch  WatchHit // set when Reason is StopWatchpoint
+}
+
+// State returns a copy of the machine registers and both stacks.
+func (vm *VM) State() State {
+	var state State
+	vm.Inspect(func(m *VM) {
+		state = m.state()
+	})
+	return state
+}
+
+func (vm *VM) state() State {
+	sp := vm.MMIO.peek(AddrStackPointer)
+	rsp := vm.MMIO.peek(AddrReturnStackPointer)
+	state := State{
+		PC:          vm.pc,
+		Status:      vm.MMIO.peek(AddrStatus),
+		Stack:       append([]byte{}, vm.MMIO.data[AddrStackStart:AddrStackStart+uint16(sp)]...),
+		ReturnStack: append([]byte{}, vm.MMIO.data[AddrReturnStackStart:AddrReturnStackStart+uint16(rsp)]...),
+		Cycles:      vm.cycles,
+	}
+	if state.Status&FlagFault != 0 {
+		state.Fault = vm.fault()
+	}
+	return state
+}
+
+func (vm *VM) SetBreakpoint(addr uint16) {
+	vm.Inspect(func(m *VM) {
+		if m.breakpoints == nil {
+			m.breakpoints = map[uint16]bool{}
+		}
+		m.breakpoints[addr] = true
+	})
+}
+
+func (vm *VM) ClearBreakpoint(addr uint16) {
+	vm.Inspect(func(m *VM) {
+		delete(m.breakpoints, addr)
+	})
+}
+
+func (vm *VM) Breakpoints() []uint16 {
+	var out []uint16
+	vm.Inspect(func(m *VM) {
+		for addr := range m.breakpoints {
+			out = append(out, addr)
+		}
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// SetWatchpoint pauses execution after any instruction that accesses addr
+// through the MMIO in the given way.
+func (vm *VM) SetWatchpoint(addr uint16, access Access) {
+	vm.Inspect(func(m *VM) {
+		if m.MMIO.watchpoints == nil {
+			m.MMIO.watchpoints = map[uint16]Access{}
+		}
+		m.MMIO.watchpoints[addr] = access
+	})
+}
+
+func (vm *VM) ClearWatchpoint(addr uint16) {
+	vm.Inspect(func(m *VM) {
+		delete(m.MMIO.watchpoints, addr)
+	})
+}
+
+// OnStop registers a hook called whenever execution pauses at a breakpoint or
+// watchpoint, halts or faults. Hooks run on the executing goroutine but
+// outside the machine lock, so they may inspect the machine. Register hooks
+// before starting the machine.
+func (vm *VM) OnStop(hook func(Stop)) {
+	vm.stopHooks = append(vm.stopHooks, hook)
+}
+
+// Reset points the PC at the entrypoint, clears the fault flag and marks the
+// machine as running without starting execution. Step, Continue, RunSync and RunFor reset a
+// machine that has not been started yet.
+func (vm *VM) Reset() {
+	vm.Inspect(func(m *VM) {
+		m.reset()
+	})
+}
+
+func (vm *VM) reset() {
+	vm.pc = binary.BigEndian.Uint16(
+		[]byte{
+			vm.MMIO.Read(0),
+			vm.MMIO.Read(1),
+		},
+	)
+	vm.MMIO.data[AddrStatus] &^= FlagFault
+	vm.running = true
+	vm.started = true
+}
+
+// Step executes a single instruction on the caller's goroutine, first
+// entering the handler of any pending interrupt. A waiting machine with no
+// interrupt pending is left waiting.
+func (vm *VM) Step() Stop {
+	return vm.exec(func() Stop {
+		return vm.report(vm.step())
+	})
+}
+
+// Continue executes on the caller's goroutine until a breakpoint or
+// watchpoint is hit, the machine halts or faults, or it waits on YIELD with
+// no interrupt pending. A breakpoint on the current PC is stepped over.
+func (vm *VM) Continue() Stop {
+	return vm.exec(func() Stop {
+		return vm.run(nil, 0)
+	})
+}
+
+// exec takes the machine lock for the duration of f and notifies stop hooks
+// once it is released.
+func (vm *VM) exec(f func() Stop) Stop {
+	vm.mu.Lock()
+	wasRunning := vm.running || !vm.started
+	stop := f()
+	vm.release()
+	if wasRunning || stop.Reason == StopBreakpoint || stop.Reason == StopWatchpoint {
+		vm.notify(stop)
+	}
+	return stop
+}
+
+func (vm *VM) notify(stop Stop) {
+	switch stop.Reason {
+	case StopBreakpoint, StopWatchpoint, StopHalted, StopFaulted:
+		for _, hook := range vm.stopHooks {
+			hook(stop)
+		}
+	}
+}
+
+func (vm *VM) step() (StopReason, *WatchHit) {
+	vm.drain()
+	if !vm.started {
+		vm.reset()
+	}
+	if reason, ok := vm.stopped(); ok {
+		return reason, nil
+	}
+	vm.deliverInterrupt()
+	vm.enterFaultHandler()
+	if reason, ok := vm.stopped(); ok {
+		return reason, nil
+	}
+	if vm.MMIO.peek(AddrStatus)&FlagWaiting != 0 {
+		return StopWaiting, nil
+	}
+
+	instr := vm.MMIO.Read(vm.pc)
+	vm.MMIO.watchHit = nil
+	vm.execute(instr)
+	vm.enterFaultHandler()
+	vm.cycles++
+
+	if reason, ok := vm.stopped(); ok {
+		return reason, nil
+	}
+	if hit := vm.MMIO.watchHit; hit != nil {
+		vm.MMIO.watchHit = nil
+		return StopWatchpoint, hit
+	}
+	return StopStep, nil
+}
+
+func (vm *VM) stopped() (StopReason, bool) {
+	if vm.running {
+		return StopStep, false
+	}
+	if vm.MMIO.peek(AddrStatus)&FlagFault != 0 {
+		return StopFaulted, true
+	}
+	return StopHalted, true
+}
+
+func (vm *VM) report(reason StopReason, hit *WatchHit) Stop {
+	stop := Stop{Reason: reason, State: vm.state()}
+	if hit != nil {
+		stop.Watch = *hit
+	}
+	return stop
+}
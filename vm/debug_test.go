@@ -0,0 +1,99 @@
+package vm
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+// stores 1 + 2 at 0x1000 then halts
+var addProgram = []byte{
+	Push16Instruction, 0x10, 0x00, // 0400
+	PushInstruction, 0x01, // 0403
+	PushInstruction, 0x02, // 0405
+	AddInstruction,   // 0407
+	StoreInstruction, // 0408
+	HaltInstruction,  // 0409
+}
+
+func newDebugVM(program []byte) *VM {
+	m := New()
+	m.LoadProgram(program)
+	m.Reset()
+	return m
+}
+
+func TestStep(t *testing.T) {
+	m := newDebugVM(addProgram)
+	var stop Stop
+	for range 2 {
+		stop = m.Step()
+	}
+	if stop.Reason != StopStep {
+		t.Fatalf("got %v, want step", stop.Reason)
+	}
+	if stop.State.PC != 0x0405 {
+		t.Fatalf("got PC %04X, want 0405", stop.State.PC)
+	}
+	if !bytes.Equal(stop.State.Stack, []byte{0x10, 0x00, 0x01}) {
+		t.Fatalf("got stack % X", stop.State.Stack)
+	}
+	if stop.State.Cycles != 2 {
+		t.Fatalf("got %d cycles, want 2", stop.State.Cycles)
+	}
+}
+
+func TestBreakpoint(t *testing.T) {
+	m := newDebugVM(addProgram)
+	m.SetBreakpoint(0x0408)
+
+	var hooked []StopReason
+	m.OnStop(func(s Stop) { hooked = append(hooked, s.Reason) })
+
+	stop := m.Continue()
+	if stop.Reason != StopBreakpoint || stop.State.PC != 0x0408 {
+		t.Fatalf("got %v at %04X, want breakpoint at 0408", stop.Reason, stop.State.PC)
+	}
+	if !bytes.Equal(stop.State.Stack, []byte{0x10, 0x00, 0x03}) {
+		t.Fatalf("got stack % X", stop.State.Stack)
+	}
+
+	stop = m.Continue()
+	if stop.Reason != StopHalted {
+		t.Fatalf("got %v, want halted", stop.Reason)
+	}
+	if got := m.MMIO.Read(0x1000); got != 3 {
+		t.Fatalf("got %d at 0x1000, want 3", got)
+	}
+	if !slices.Equal(hooked, []StopReason{StopBreakpoint, StopHalted}) {
+		t.Fatalf("hook saw %v", hooked)
+	}
+}
+
+func TestWatchpoint(t *testing.T) {
+	m := newDebugVM(addProgram)
+	m.SetWatchpoint(0x1000, AccessWrite)
+
+	stop := m.Continue()
+	if stop.Reason != StopWatchpoint {
+		t.Fatalf("got %v, want watchpoint", stop.Reason)
+	}
+	want := WatchHit{Addr: 0x1000, Access: AccessWrite, Value: 3}
+	if stop.Watch != want {
+		t.Fatalf("got %+v, want %+v", stop.Watch, want)
+	}
+	if stop.State.PC != 0x0409 {
+		t.Fatalf("got PC %04X, want 0409", stop.State.PC)
+	}
+}
+
+func TestStepFault(t *testing.T) {
+	m := newDebugVM([]byte{DropInstruction})
+	stop := m.Step()
+	if stop.Reason != StopFaulted {
+		t.Fatalf("got %v, want faulted", stop.Reason)
+	}
+	if !slices.Equal(stop.State.Flags(), []string{"fault", "stack underflow"}) {
+		t.Fatalf("got flags %v", stop.State.Flags())
+	}
+}
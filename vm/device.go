@@ -4,3 +4,12 @@ type Device interface {
 	Write(addr uint16, data byte)
 	Read(addr uint16) byte
 }
+
+// StatefulDevice is implemented by devices whose registers are saved in
+// snapshots. SaveState is called between instructions and LoadState before
+// the restored machine runs.
+type StatefulDevice interface {
+	Device
+	SaveState() ([]byte, error)
+	LoadState(data []byte) error
+}
@@ -0,0 +1,134 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// FaultCause identifies why the machine faulted. It is stored in the extended
+// fault register at AddrFaultCause.
+type FaultCause byte
+
+const (
+	FaultNone FaultCause = iota
+	FaultStackOverflow
+	FaultStackUnderflow
+	FaultReturnStackOverflow
+	FaultReturnStackUnderflow
+	FaultDivideByZero
+	FaultInvalidOpcode
+
+	// FaultDouble is set in the cause of a fault raised while the fault
+	// handler was running.
+	FaultDouble FaultCause = 0x80
+)
+
+// faultFlags are the status flags set alongside FlagFault for each cause.
+var faultFlags = map[FaultCause]byte{
+	FaultStackOverflow:        FlagStackOverflow,
+	FaultStackUnderflow:       FlagStackUnderflow,
+	FaultReturnStackOverflow:  FlagReturnStackOverflow,
+	FaultReturnStackUnderflow: FlagReturnStackUnderflow,
+	FaultDivideByZero:         FlagDivideByZero,
+}
+
+func (c FaultCause) String() string {
+	if c&FaultDouble != 0 {
+		return "double fault: " + (c &^ FaultDouble).String()
+	}
+	switch c {
+	case FaultNone:
+		return "none"
+	case FaultStackOverflow:
+		return "stack overflow"
+	case FaultStackUnderflow:
+		return "stack underflow"
+	case FaultReturnStackOverflow:
+		return "return stack overflow"
+	case FaultReturnStackUnderflow:
+		return "return stack underflow"
+	case FaultDivideByZero:
+		return "divide by zero"
+	case FaultInvalidOpcode:
+		return "invalid opcode"
+	}
+	return fmt.Sprintf("FaultCause(%d)", byte(c))
+}
+
+// FaultInfo is the content of the extended fault register: what went wrong
+// and the instruction that was executing when it did.
+type FaultInfo struct {
+	Cause  FaultCause
+	PC     uint16
+	Opcode byte
+}
+
+func (f FaultInfo) String() string {
+	return fmt.Sprintf("%s at 0x%04X (opcode 0x%02X)", f.Cause, f.PC, f.Opcode)
+}
+
+// Fault returns the extended fault register. It records the most recent
+// fault even after the machine is reset.
+func (vm *VM) Fault() FaultInfo {
+	var info FaultInfo
+	vm.Inspect(func(m *VM) {
+		info = m.fault()
+	})
+	return info
+}
+
+func (vm *VM) fault() FaultInfo {
+	return FaultInfo{
+		Cause:  FaultCause(vm.MMIO.peek(AddrFaultCause)),
+		PC:     binary.BigEndian.Uint16(vm.MMIO.data[AddrFaultPC:]),
+		Opcode: vm.MMIO.peek(AddrFaultOpcode),
+	}
+}
+
+// setFault records the cause along with the PC and opcode of the
+// instruction being executed. The rest of the instruction has no effect on
+// the stacks or memory. Without a fault handler, or if the handler itself
+// faults, the machine stops.
+func (vm *VM) setFault(cause FaultCause) {
+	if vm.faulting {
+		return
+	}
+	vm.faulting = true
+
+	vector := binary.BigEndian.Uint16(vm.MMIO.data[AddrFaultVector:])
+	handling := vm.MMIO.peek(AddrStatus)&FlagFault != 0
+	if handling {
+		cause |= FaultDouble
+	}
+
+	vm.MMIO.Write(AddrFaultCause, byte(cause))
+	vm.MMIO.Write(AddrFaultPC, byte(vm.pc>>8))
+	vm.MMIO.Write(AddrFaultPC+1, byte(vm.pc&0xFF))
+	vm.MMIO.Write(AddrFaultOpcode, vm.MMIO.peek(vm.pc))
+	vm.MMIO.Write(AddrStatus, faultFlags[cause&^FaultDouble]|FlagFault)
+
+	if vector == 0 || handling {
+		vm.running = false
+		return
+	}
+	// give the handler room on a stack that overflowed
+	switch cause {
+	case FaultStackOverflow:
+		vm.MMIO.Write(AddrStackPointer, 0)
+	case FaultReturnStackOverflow:
+		vm.MMIO.Write(AddrReturnStackPointer, 0)
+	}
+}
+
+// enterFaultHandler jumps to the fault vector once the faulting instruction
+// has been abandoned. The handler runs with the fault flag set; clearing it
+// tells the machine the fault has been dealt with.
+func (vm *VM) enterFaultHandler() {
+	if !vm.faulting {
+		return
+	}
+	vm.faulting = false
+	if vm.running {
+		vm.pc = binary.BigEndian.Uint16(vm.MMIO.data[AddrFaultVector:])
+	}
+}
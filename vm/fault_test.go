@@ -0,0 +1,127 @@
+package vm
+
+import "testing"
+
+func TestInvalidOpcode(t *testing.T) {
+	for _, op := range []byte{0x0C, 0x30, 0xFF} {
+		m := New()
+		m.LoadProgram([]byte{PushInstruction, 0x01, op})
+
+		stop := m.RunFor(10)
+		if stop.Reason != StopFaulted {
+			t.Fatalf("0x%02X: got %v, want faulted", op, stop.Reason)
+		}
+		want := FaultInfo{Cause: FaultInvalidOpcode, PC: 0x0402, Opcode: op}
+		if stop.State.Fault != want {
+			t.Errorf("0x%02X: got fault %v, want %v", op, stop.State.Fault, want)
+		}
+		if stop.State.Status != FlagFault {
+			t.Errorf("0x%02X: got status %08b, want only the fault flag", op, stop.State.Status)
+		}
+	}
+}
+
+func TestFaultRegister(t *testing.T) {
+	m := New()
+	m.LoadProgram([]byte{PushInstruction, 0x00, PushInstruction, 0x01, DivInstruction})
+	m.RunFor(10)
+
+	if got := m.Fault(); got != (FaultInfo{Cause: FaultDivideByZero, PC: 0x0404, Opcode: DivInstruction}) {
+		t.Fatalf("got %v", got)
+	}
+	var mem []byte
+	m.Inspect(func(m *VM) { mem = append(mem, m.MMIO.ReadData(AddrFaultCause, 4)...) })
+	if want := []byte{byte(FaultDivideByZero), 0x04, 0x04, DivInstruction}; string(mem) != string(want) {
+		t.Fatalf("fault register % X, want % X", mem, want)
+	}
+}
+
+const faultHandler = 0x0500
+
+func newFaultVM(program, handler []byte) *VM {
+	m := New()
+	m.LoadProgram(program)
+	m.MMIO.WriteData(faultHandler, handler)
+	m.MMIO.WriteData(AddrFaultVector, []byte{faultHandler >> 8, faultHandler & 0xFF})
+	return m
+}
+
+// clears the fault flag, copies the faulting PC to 0x1000 and jumps to 0x0480
+var recoveringHandler = []byte{
+	Push16Instruction, 0x00, 0x04, PushInstruction, 0x00, StoreInstruction,
+	Push16Instruction, 0x10, 0x00, Push16Instruction, 0x00, 0x06, Load16Instruction, Store16Instruction,
+	Push16Instruction, 0x04, 0x80, PushInstruction, 0x01, JnzInstruction,
+}
+
+func TestFaultHandler(t *testing.T) {
+	m := newFaultVM([]byte{PushInstruction, 0x01, DropInstruction, DropInstruction}, recoveringHandler)
+	m.MMIO.WriteData(0x0480, []byte{HaltInstruction})
+
+	stop := m.RunFor(100)
+	if stop.Reason != StopHalted || stop.State.PC != 0x0481 {
+		t.Fatalf("got %v at %04X, want halted after recovering", stop.Reason, stop.State.PC)
+	}
+	if got := peek(m, 0x1001); got != 0x03 {
+		t.Fatalf("handler saw faulting PC low byte %02X, want 03", got)
+	}
+	if got := m.Fault(); got.Cause != FaultStackUnderflow || got.PC != 0x0403 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestFaultHandlerAgain(t *testing.T) {
+	// after recovering, a second fault is handled rather than a double fault
+	m := newFaultVM([]byte{DropInstruction}, recoveringHandler)
+	m.MMIO.WriteData(0x0480, []byte{PushInstruction, 0x00, PushInstruction, 0x00, DivInstruction})
+
+	stop := m.RunFor(60)
+	if stop.Reason != StopBudget {
+		t.Fatalf("got %v, want the handler to keep recovering", stop.Reason)
+	}
+	if got := m.Fault(); got.Cause != FaultDivideByZero {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestDoubleFault(t *testing.T) {
+	m := newFaultVM([]byte{DropInstruction}, []byte{RetInstruction})
+
+	stop := m.RunFor(10)
+	if stop.Reason != StopFaulted {
+		t.Fatalf("got %v, want faulted", stop.Reason)
+	}
+	want := FaultInfo{Cause: FaultDouble | FaultReturnStackUnderflow, PC: faultHandler, Opcode: RetInstruction}
+	if stop.State.Fault != want {
+		t.Fatalf("got %v, want %v", stop.State.Fault, want)
+	}
+	if stop.State.Status != FlagFault|FlagReturnStackUnderflow {
+		t.Fatalf("got status %08b", stop.State.Status)
+	}
+}
+
+func TestFaultAbandonsInstruction(t *testing.T) {
+	// STORE with one byte on the stack must not write to address 0
+	m := newFaultVM([]byte{PushInstruction, 0x55, StoreInstruction}, []byte{HaltInstruction})
+	stop := m.RunFor(10)
+	if stop.Reason != StopHalted {
+		t.Fatalf("got %v, want halted in the handler", stop.Reason)
+	}
+	if entry := peek(m, AddrEntrypoint); entry != 0x04 {
+		t.Fatalf("faulting STORE wrote %02X to 0x0000", entry)
+	}
+	if len(stop.State.Stack) != 0 {
+		t.Fatalf("stack % X, want empty", stop.State.Stack)
+	}
+}
+
+func TestFaultHandlerStackOverflow(t *testing.T) {
+	program := []byte{PushInstruction, 0x01, Push16Instruction, 0x04, 0x00, PushInstruction, 0x01, JnzInstruction}
+	m := newFaultVM(program, []byte{PushInstruction, 0x07, HaltInstruction})
+	stop := m.RunFor(10000)
+	if stop.Reason != StopHalted {
+		t.Fatalf("got %v, want halted in the handler", stop.Reason)
+	}
+	if string(stop.State.Stack) != "\x07" {
+		t.Fatalf("handler stack % X, want 07", stop.State.Stack)
+	}
+}
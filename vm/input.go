@@ -0,0 +1,89 @@
+package vm
+
+// Input is an event from outside the machine, such as a message arriving or
+// a device raising an interrupt. Inputs are the only way the outside world
+// changes a running machine, so recording each one along with the cycle it
+// was applied at is enough to replay an execution.
+type Input interface {
+	// Apply is called between instructions with exclusive access to the
+	// machine.
+	Apply(m *VM)
+}
+
+// Deliver queues in to be applied between instructions. It never blocks and
+// may be called from any goroutine, including the machine's own devices. A
+// machine in replay mode drops delivered inputs.
+func (vm *VM) Deliver(in Input) {
+	if vm.replaying.Load() {
+		return
+	}
+	vm.Post(func(m *VM) {
+		for _, hook := range m.inputHooks {
+			hook(m.cycles, in)
+		}
+		in.Apply(m)
+	})
+	for _, hook := range vm.wakeHooks {
+		hook()
+	}
+}
+
+// OnWake registers a hook called on the delivering goroutine after each
+// input is delivered, so that a scheduler can resume a machine it parked
+// while it was waiting. Register hooks before starting the machine.
+func (vm *VM) OnWake(hook func()) {
+	vm.wakeHooks = append(vm.wakeHooks, hook)
+}
+
+// OnInput registers a hook called with each delivered input as it is
+// applied, along with the number of instructions executed before it. Hooks
+// run with exclusive access to the machine and must not block. Register
+// hooks before starting the machine.
+func (vm *VM) OnInput(hook func(cycle uint64, in Input)) {
+	vm.inputHooks = append(vm.inputHooks, hook)
+}
+
+// Replay puts the machine in replay mode. Inputs from Deliver, Interrupt and
+// RaiseInterrupt are dropped; a replayer applies recorded inputs with
+// Inspect instead, at the cycles they were recorded at.
+func (vm *VM) Replay() {
+	vm.replaying.Store(true)
+}
+
+// InterruptInput queues an interrupt raised with Interrupt.
+type InterruptInput struct {
+	CallbackPtr uint16
+	Dropped     bool // the queue was full, so only the overflow flag is set
+}
+
+func (in InterruptInput) Apply(m *VM) {
+	m.qmu.Lock()
+	defer m.qmu.Unlock()
+	if m.inflight > 0 && !in.Dropped {
+		m.inflight--
+	}
+	if in.Dropped || len(m.pending) >= InterruptQueueSize {
+		m.overflowed = true
+	} else {
+		m.pending = append(m.pending, in.CallbackPtr)
+	}
+	m.interrupted.Store(true)
+}
+
+// LineInput raises a device's line on the interrupt controller.
+type LineInput struct {
+	Slot int
+}
+
+func (in LineInput) Apply(m *VM) {
+	c := m.controller
+	if c == nil {
+		return
+	}
+	m.qmu.Lock()
+	c.pending |= 1 << in.Slot
+	if c.ready() {
+		m.interrupted.Store(true)
+	}
+	m.qmu.Unlock()
+}
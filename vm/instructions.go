@@ -51,6 +51,7 @@ const (
 	Gt16Instruction    byte = 0x49
 	LtInstruction      byte = 0x4A
 	Lt16Instruction    byte = 0x4B
+	RetiInstruction    byte = 0x4C
 	PushInstruction    byte = 0x50
 	Push16Instruction  byte = 0x51
 	StoreInstruction   byte = 0x52
@@ -102,6 +103,7 @@ var InstrName = map[byte]string{
 	JnzInstruction:     "Jnz",
 	CallInstruction:    "Call",
 	RetInstruction:     "Ret",
+	RetiInstruction:    "Reti",
 	EqInstruction:      "Eq",
 	Eq16Instruction:    "Eq16",
 	NqInstruction:      "Nq",
@@ -117,3 +119,10 @@ var InstrName = map[byte]string{
 	LoadInstruction:    "Load",
 	Load16Instruction:  "Load16",
 }
+
+// InstrImmediate is the number of operand bytes that follow an opcode in the
+// instruction stream. Opcodes not listed take no operand.
+var InstrImmediate = map[byte]int{
+	PushInstruction:   1,
+	Push16Instruction: 2,
+}
@@ -0,0 +1,107 @@
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// InterruptQueueSize is the number of interrupts that can be pending before
+// further interrupts are dropped.
+const InterruptQueueSize = 16
+
+var ErrInterruptOverflow = errors.New("interrupt queue full")
+
+// Interrupt queues an interrupt whose handler address is stored at
+// callbackPtr. It never blocks: the interrupt is delivered between
+// instructions, pushing the current PC onto the return stack and jumping to
+// the handler, which returns with RETI. A waiting machine is resumed.
+//
+// Interrupts queued this way bypass any interrupt controller; devices should
+// prefer RaiseInterrupt.
+//
+// If InterruptQueueSize interrupts are already pending the interrupt is
+// dropped, the interrupt overflow status flag is set and ErrInterruptOverflow
+// is returned.
+func (vm *VM) Interrupt(callbackPtr uint16) error {
+	if vm.replaying.Load() {
+		return nil
+	}
+	vm.qmu.Lock()
+	full := len(vm.pending)+vm.inflight >= InterruptQueueSize
+	if !full {
+		vm.inflight++
+	}
+	vm.qmu.Unlock()
+
+	vm.Deliver(InterruptInput{CallbackPtr: callbackPtr, Dropped: full})
+	if full {
+		return ErrInterruptOverflow
+	}
+	return nil
+}
+
+func (vm *VM) signal() {
+	select {
+	case vm.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverInterrupt jumps to the next pending interrupt handler, if any. Lines
+// raised through an interrupt controller take precedence over interrupts
+// queued with Interrupt.
+func (vm *VM) deliverInterrupt() {
+	if !vm.interrupted.Load() || !vm.running {
+		return
+	}
+	vm.qmu.Lock()
+	overflowed := vm.overflowed
+	vm.overflowed = false
+	var callbackPtr uint16
+	slot, fromController := 0, false
+	c := vm.controller
+	if c != nil {
+		slot, fromController = c.next()
+	}
+	ok := fromController || len(vm.pending) > 0
+	if !fromController && ok {
+		callbackPtr = vm.pending[0]
+		vm.pending = vm.pending[1:]
+	}
+	vm.interrupted.Store(len(vm.pending) > 0 || (c != nil && c.ready()))
+	vm.qmu.Unlock()
+
+	if overflowed {
+		vm.SetFlag(FlagInterruptOverflow)
+	}
+	if fromController {
+		callbackPtr = c.enter(slot)
+	}
+	if ok {
+		vm.enterHandler(callbackPtr)
+	}
+}
+
+func (vm *VM) enterHandler(callbackPtr uint16) {
+	vm.PushReturnStack(vm.pc)
+	if vm.faulting {
+		return
+	}
+	addr := make([]byte, 2)
+	addr[0] = vm.MMIO.Read(callbackPtr)
+	addr[1] = vm.MMIO.Read(callbackPtr + 1)
+	vm.pc = binary.BigEndian.Uint16(addr)
+	vm.UnsetFlag(FlagWaiting)
+	if vm.Debug {
+		fmt.Printf("interrupt: %04X\n", vm.pc)
+	}
+}
+
+// PendingInterrupts returns the callback pointers of interrupts that have
+// not been delivered yet, oldest first.
+func (vm *VM) PendingInterrupts() []uint16 {
+	vm.qmu.Lock()
+	defer vm.qmu.Unlock()
+	return append([]uint16(nil), vm.pending...)
+}
@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+const handlerPtr uint16 = 0x3000
+
+// counts up at 0x1000 forever; the handler at 0x0440 marks 0x1001 and returns
+var counterProgram = []byte{
+	Push16Instruction, 0x10, 0x00, // 0400
+	Push16Instruction, 0x10, 0x00, // 0403
+	LoadInstruction,               // 0406
+	IncInstruction,                // 0407
+	StoreInstruction,              // 0408
+	Push16Instruction, 0x04, 0x00, // 0409
+	PushInstruction, 0x01, // 040C
+	JnzInstruction, // 040E
+}
+
+var markHandler = []byte{
+	Push16Instruction, 0x10, 0x01,
+	PushInstruction, 0xAA,
+	StoreInstruction,
+	RetiInstruction,
+}
+
+func newInterruptVM(program []byte) *VM {
+	m := New()
+	m.LoadProgram(program)
+	m.MMIO.WriteData(0x0440, markHandler)
+	m.MMIO.WriteData(handlerPtr, []byte{0x04, 0x40})
+	return m
+}
+
+func TestPreemptiveInterrupt(t *testing.T) {
+	m := newInterruptVM(counterProgram)
+	m.RunFor(20)
+	before := m.State()
+	if err := m.Interrupt(handlerPtr); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := m.Step()
+	if got := stop.State.ReturnAddresses(); len(got) != 1 || got[0] != before.PC {
+		t.Fatalf("return stack %04X, want [%04X]", got, before.PC)
+	}
+	if stop.State.PC != 0x0443 {
+		t.Fatalf("got PC %04X, want 0443 inside the handler", stop.State.PC)
+	}
+
+	m.RunFor(3)
+	after := m.State()
+	if after.PC != before.PC {
+		t.Fatalf("handler returned to %04X, want %04X", after.PC, before.PC)
+	}
+	var marked byte
+	m.Inspect(func(m *VM) { marked = m.MMIO.Read(0x1001) })
+	if marked != 0xAA {
+		t.Fatalf("handler did not run, got %X", marked)
+	}
+	if len(after.ReturnStack) != 0 || len(after.Stack) != len(before.Stack) {
+		t.Fatalf("handler left stacks unbalanced: % X / % X", after.Stack, after.ReturnStack)
+	}
+}
+
+func TestInterruptResumesYield(t *testing.T) {
+	m := newInterruptVM([]byte{YieldInstruction})
+	if stop := m.RunFor(10); stop.Reason != StopWaiting {
+		t.Fatalf("got %v, want waiting", stop.Reason)
+	}
+	m.Interrupt(handlerPtr)
+
+	// the handler returns to the YIELD, which waits again
+	stop := m.RunFor(10)
+	if stop.Reason != StopWaiting || stop.State.PC != 0x0400 {
+		t.Fatalf("got %v at %04X, want waiting at 0400", stop.Reason, stop.State.PC)
+	}
+	if len(stop.State.ReturnStack) != 0 {
+		t.Fatalf("return stack not empty: % X", stop.State.ReturnStack)
+	}
+}
+
+func TestInterruptOverflow(t *testing.T) {
+	m := newInterruptVM([]byte{YieldInstruction})
+	for i := range InterruptQueueSize {
+		if err := m.Interrupt(handlerPtr); err != nil {
+			t.Fatalf("interrupt %d: %v", i, err)
+		}
+	}
+	if err := m.Interrupt(handlerPtr); !errors.Is(err, ErrInterruptOverflow) {
+		t.Fatalf("got %v, want ErrInterruptOverflow", err)
+	}
+	if n := len(m.PendingInterrupts()); n != InterruptQueueSize {
+		t.Fatalf("got %d pending, want %d", n, InterruptQueueSize)
+	}
+
+	stop := m.Step()
+	if stop.State.Status&FlagInterruptOverflow == 0 {
+		t.Fatalf("overflow flag not set: %08b", stop.State.Status)
+	}
+}
@@ -1,14 +1,43 @@
 package vm
 
-import "fmt"
-
 type MMIO struct {
 	data [65536]byte
 
 	devices [16]Device
+
+	watchpoints map[uint16]Access
+	watchHit    *WatchHit
+}
+
+// Access describes the kind of memory access a watchpoint triggers on.
+type Access byte
+
+const (
+	AccessRead  Access = 0b01
+	AccessWrite Access = 0b10
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessRead:
+		return "read"
+	case AccessWrite:
+		return "write"
+	case AccessRead | AccessWrite:
+		return "read/write"
+	}
+	return "none"
+}
+
+// WatchHit records the first watched access made during an instruction.
+type WatchHit struct {
+	Addr   uint16
+	Access Access
+	Value  byte
 }
 
-func (m *MMIO) WriteByte(addr uint16, data byte) {
+func (m *MMIO) Write(addr uint16, data byte) {
+	m.watch(addr, AccessWrite, data)
 	if (addr & 0xFF00) == 0x0300 {
 		m.writeToDevice(addr, data)
 		return
@@ -16,11 +45,15 @@ func (m *MMIO) WriteByte(addr uint16, data byte) {
 	m.data[addr] = data
 }
 
-func (m *MMIO) ReadByte(addr uint16) byte {
+func (m *MMIO) Read(addr uint16) byte {
+	var data byte
 	if (addr & 0xFF00) == 0x0300 {
-		return m.readFromDevice(addr)
+		data = m.readFromDevice(addr)
+	} else {
+		data = m.data[addr]
 	}
-	return m.data[addr]
+	m.watch(addr, AccessRead, data)
+	return data
 }
 
 func (m *MMIO) ReadData(addr uint16, length int) []byte {
@@ -28,10 +61,21 @@ func (m *MMIO) ReadData(addr uint16, length int) []byte {
 }
 
 func (m *MMIO) WriteData(addr uint16, data []byte) {
-	fmt.Printf("WRITE DATA %X\n", addr)
 	copy(m.data[addr:int(addr)+len(data)], data[:])
 }
 
+func (m *MMIO) watch(addr uint16, access Access, data byte) {
+	if m.watchHit != nil || m.watchpoints[addr]&access == 0 {
+		return
+	}
+	m.watchHit = &WatchHit{Addr: addr, Access: access, Value: data}
+}
+
+// peek reads memory without touching devices or triggering watchpoints.
+func (m *MMIO) peek(addr uint16) byte {
+	return m.data[addr]
+}
+
 func (m *MMIO) writeToDevice(addr uint16, data byte) {
 	deviceNumber := (addr & 0x00F0) >> 4
 	if device := m.devices[deviceNumber]; device != nil {
@@ -0,0 +1,59 @@
+package vm
+
+import "context"
+
+// cancelCheckInterval is how many instructions RunSync executes between
+// checks of its context.
+const cancelCheckInterval = 1024
+
+// RunSync executes on the caller's goroutine until the machine halts, faults,
+// waits on YIELD with no interrupt pending, hits a breakpoint or watchpoint,
+// or ctx is done.
+func (vm *VM) RunSync(ctx context.Context) Stop {
+	return vm.exec(func() Stop {
+		return vm.run(ctx, 0)
+	})
+}
+
+// RunFor is like RunSync but executes at most maxCycles instructions.
+func (vm *VM) RunFor(maxCycles uint64) Stop {
+	return vm.exec(func() Stop {
+		if maxCycles == 0 {
+			return vm.report(StopBudget, nil)
+		}
+		return vm.run(nil, maxCycles)
+	})
+}
+
+// run is the loop shared by Run, Continue, RunSync and RunFor. A zero budget
+// is unlimited and a nil ctx is never cancelled. The caller holds vm.mu.
+func (vm *VM) run(ctx context.Context, budget uint64) Stop {
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	var executed uint64
+	for {
+		if done != nil && executed%cancelCheckInterval == 0 {
+			select {
+			case <-done:
+				return vm.report(StopCancelled, nil)
+			default:
+			}
+		}
+
+		reason, hit := vm.step()
+		if reason == StopStep && vm.breakpoints[vm.pc] {
+			reason = StopBreakpoint
+		}
+		if reason == StopStep {
+			executed++
+			if budget > 0 && executed >= budget {
+				return vm.report(StopBudget, nil)
+			}
+			continue
+		}
+
+		return vm.report(reason, hit)
+	}
+}
@@ -0,0 +1,106 @@
+package vm
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRunForBudget(t *testing.T) {
+	m := New()
+	// jump to self
+	m.LoadProgram([]byte{
+		Push16Instruction, 0x04, 0x00,
+		PushInstruction, 0x01,
+		JnzInstruction,
+	})
+	stop := m.RunFor(30)
+	if stop.Reason != StopBudget {
+		t.Fatalf("got %v, want budget exhausted", stop.Reason)
+	}
+	if stop.State.Cycles != 30 || stop.State.PC != 0x0400 {
+		t.Fatalf("got %d cycles at %04X, want 30 at 0400", stop.State.Cycles, stop.State.PC)
+	}
+
+	stop = m.RunFor(3)
+	if stop.State.Cycles != 33 {
+		t.Fatalf("got %d cycles, want 33", stop.State.Cycles)
+	}
+}
+
+func TestRunSyncHalts(t *testing.T) {
+	m := New()
+	m.LoadProgram(addProgram)
+	stop := m.RunSync(context.Background())
+	if stop.Reason != StopHalted {
+		t.Fatalf("got %v, want halted", stop.Reason)
+	}
+	if got := m.MMIO.Read(0x1000); got != 3 {
+		t.Fatalf("got %d at 0x1000, want 3", got)
+	}
+	if again := m.RunSync(context.Background()); again.Reason != StopHalted || again.State.Cycles != stop.State.Cycles {
+		t.Fatalf("halted machine ran again: %v after %d cycles", again.Reason, again.State.Cycles)
+	}
+}
+
+func TestRunSyncWaiting(t *testing.T) {
+	m := New()
+	m.LoadProgram([]byte{PushInstruction, 0x01, YieldInstruction})
+	stop := m.RunSync(context.Background())
+	if stop.Reason != StopWaiting {
+		t.Fatalf("got %v, want waiting", stop.Reason)
+	}
+	if stop.State.Status&FlagWaiting == 0 {
+		t.Fatalf("waiting flag not set: %08b", stop.State.Status)
+	}
+}
+
+func TestRunSyncCancelled(t *testing.T) {
+	m := New()
+	m.LoadProgram([]byte{
+		Push16Instruction, 0x04, 0x00,
+		PushInstruction, 0x01,
+		JnzInstruction,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if stop := m.RunSync(ctx); stop.Reason != StopCancelled {
+		t.Fatalf("got %v, want cancelled", stop.Reason)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	m := New()
+	m.LoadProgram([]byte{
+		Push16Instruction, 0x10, 0x00,
+		PushInstruction, 0x2A,
+		StoreInstruction,
+		Push16Instruction, 0x04, 0x00,
+		PushInstruction, 0x01,
+		JnzInstruction,
+	})
+	stopped := make(chan Stop, 1)
+	m.OnStop(func(s Stop) { stopped <- s })
+	m.Run()
+
+	for range 100 {
+		m.Post(func(m *VM) {
+			m.MMIO.Write(0x2000, m.MMIO.Read(0x2000)+1)
+		})
+		_ = m.State()
+	}
+	// let the program get at least one store in before stopping it
+	for m.State().Cycles < 3 {
+	}
+	m.Stop()
+	if stop := <-stopped; stop.Reason != StopHalted {
+		t.Fatalf("got %v, want halted", stop.Reason)
+	}
+
+	var count, stored byte
+	m.Inspect(func(m *VM) {
+		count, stored = m.MMIO.Read(0x2000), m.MMIO.Read(0x1000)
+	})
+	if count != 100 || stored != 0x2A {
+		t.Fatalf("got count %d and stored %X, want 100 and 2A", count, stored)
+	}
+}
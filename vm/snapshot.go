@@ -0,0 +1,188 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SnapshotVersion is the version of the format written by Snapshot.
+const SnapshotVersion = 1
+
+var snapshotMagic = [4]byte{'C', 'A', 'P', 'S'}
+
+var (
+	ErrNotSnapshot     = errors.New("not a snapshot")
+	ErrSnapshotVersion = errors.New("unsupported snapshot version")
+)
+
+const (
+	snapshotRunning = 1 << iota
+	snapshotStarted
+	snapshotOverflowed
+)
+
+/**
+Snapshot format, big endian
+
+Field        Size          Description
+-----        ----          -----------
+magic        4             "CAPS"
+version      2             SnapshotVersion
+pc           2
+state        1             bit 0 running, bit 1 started, bit 2 interrupt overflow
+cycles       8
+memory       65536         including stack pointers and status flags
+pending      2 + 2n        count, then the callback pointer of each pending interrupt
+devices      1 + ...       count, then per device: slot (1), length (4), state
+**/
+
+type snapshotHeader struct {
+	Magic   [4]byte
+	Version uint16
+	PC      uint16
+	State   byte
+	Cycles  uint64
+}
+
+// Snapshot writes the machine to w between instructions. Devices
+// implementing StatefulDevice have their state included.
+func (vm *VM) Snapshot(w io.Writer) error {
+	var err error
+	vm.Inspect(func(m *VM) {
+		err = m.snapshot(w)
+	})
+	return err
+}
+
+func (vm *VM) snapshot(w io.Writer) error {
+	header := snapshotHeader{
+		Magic:   snapshotMagic,
+		Version: SnapshotVersion,
+		PC:      vm.pc,
+		Cycles:  vm.cycles,
+	}
+	if vm.running {
+		header.State |= snapshotRunning
+	}
+	if vm.started {
+		header.State |= snapshotStarted
+	}
+	vm.qmu.Lock()
+	pending := append([]uint16(nil), vm.pending...)
+	if vm.overflowed {
+		header.State |= snapshotOverflowed
+	}
+	vm.qmu.Unlock()
+
+	devices := map[int][]byte{}
+	for slot, device := range vm.MMIO.devices {
+		if d, ok := device.(StatefulDevice); ok {
+			state, err := d.SaveState()
+			if err != nil {
+				return fmt.Errorf("snapshot: device %d: %w", slot, err)
+			}
+			devices[slot] = state
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	binary.Write(bw, binary.BigEndian, header)
+	bw.Write(vm.MMIO.data[:])
+	binary.Write(bw, binary.BigEndian, uint16(len(pending)))
+	binary.Write(bw, binary.BigEndian, pending)
+	bw.WriteByte(byte(len(devices)))
+	for slot := range vm.MMIO.devices {
+		state, ok := devices[slot]
+		if !ok {
+			continue
+		}
+		bw.WriteByte(byte(slot))
+		binary.Write(bw, binary.BigEndian, uint32(len(state)))
+		bw.Write(state)
+	}
+	return bw.Flush()
+}
+
+// Restore reads a machine written by Snapshot. Breakpoints, watchpoints and
+// stop hooks are not part of a snapshot. Devices are not either: each setup
+// function is called with the new machine to register them, after which
+// saved device state is loaded into the device in the same slot. The
+// restored machine resumes where it was when started with any of the run
+// methods.
+func Restore(r io.Reader, setup ...func(*VM)) (*VM, error) {
+	var header snapshotHeader
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("restore: %w", err)
+	}
+	if header.Magic != snapshotMagic {
+		return nil, ErrNotSnapshot
+	}
+	if header.Version != SnapshotVersion {
+		return nil, fmt.Errorf("restore: %w %d", ErrSnapshotVersion, header.Version)
+	}
+
+	m := New()
+	m.pc = header.PC
+	m.cycles = header.Cycles
+	m.running = header.State&snapshotRunning != 0
+	m.started = header.State&snapshotStarted != 0
+	m.overflowed = header.State&snapshotOverflowed != 0
+	if _, err := io.ReadFull(r, m.MMIO.data[:]); err != nil {
+		return nil, fmt.Errorf("restore: memory: %w", err)
+	}
+
+	var count uint16
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("restore: interrupts: %w", err)
+	}
+	if count > InterruptQueueSize {
+		return nil, fmt.Errorf("restore: %d pending interrupts, more than the queue holds", count)
+	}
+	m.pending = make([]uint16, count)
+	if err := binary.Read(r, binary.BigEndian, m.pending); err != nil {
+		return nil, fmt.Errorf("restore: interrupts: %w", err)
+	}
+	m.interrupted.Store(len(m.pending) > 0 || m.overflowed)
+
+	var devices [1]byte
+	if _, err := io.ReadFull(r, devices[:]); err != nil {
+		return nil, fmt.Errorf("restore: devices: %w", err)
+	}
+	states := map[int][]byte{}
+	for range int(devices[0]) {
+		var entry struct {
+			Slot   byte
+			Length uint32
+		}
+		if err := binary.Read(r, binary.BigEndian, &entry); err != nil {
+			return nil, fmt.Errorf("restore: devices: %w", err)
+		}
+		// read the state as it arrives rather than trusting the length up front
+		var state bytes.Buffer
+		if _, err := io.CopyN(&state, r, int64(entry.Length)); err != nil {
+			return nil, fmt.Errorf("restore: device %d: %w", entry.Slot, err)
+		}
+		states[int(entry.Slot)] = state.Bytes()
+	}
+
+	for _, f := range setup {
+		f(m)
+	}
+	for slot, state := range states {
+		if slot >= len(m.MMIO.devices) {
+			return nil, fmt.Errorf("restore: device slot %d out of range", slot)
+		}
+		d, ok := m.MMIO.devices[slot].(StatefulDevice)
+		if !ok {
+			return nil, fmt.Errorf("restore: no device in slot %d to load saved state into", slot)
+		}
+		if err := d.LoadState(state); err != nil {
+			return nil, fmt.Errorf("restore: device %d: %w", slot, err)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,108 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	m := newControllerVM(t, counterProgram)
+	m.RunFor(25)
+	m.MMIO.Write(ctrl|0x03, 1<<5)
+	m.RaiseInterrupt(5)
+	m.Interrupt(vectorTable + 7*2)
+
+	var buf bytes.Buffer
+	if err := m.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Restore(&buf, func(r *VM) {
+		r.RegisterDevice(controllerSlot, NewInterruptController())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := r.State(), m.State(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored state %+v, want %+v", got, want)
+	}
+	if got, want := r.PendingInterrupts(), m.PendingInterrupts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored pending %04X, want %04X", got, want)
+	}
+	if got := r.MMIO.Read(ctrl | 0x05); got != 1<<5 {
+		t.Fatalf("restored controller pending %08b", got)
+	}
+
+	// both machines carry on identically, unmasking the saved line
+	for _, x := range []*VM{m, r} {
+		x.MMIO.Write(ctrl|0x03, 0)
+		x.RunFor(200)
+	}
+	if got, want := r.State(), m.State(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("diverged: %+v, want %+v", got, want)
+	}
+	var a, b []byte
+	m.Inspect(func(m *VM) { a = append(a, m.MMIO.data[:]...) })
+	r.Inspect(func(r *VM) { b = append(b, r.MMIO.data[:]...) })
+	if !bytes.Equal(a, b) {
+		t.Fatal("memory diverged after restore")
+	}
+	if peek(r, 0x1005) != 0xA5 || peek(r, 0x1007) != 0xA7 {
+		t.Fatal("restored interrupts were not delivered")
+	}
+}
+
+func TestRestoreErrors(t *testing.T) {
+	if _, err := Restore(bytes.NewReader([]byte("dump.hex contents"))); !errors.Is(err, ErrNotSnapshot) {
+		t.Errorf("got %v, want ErrNotSnapshot", err)
+	}
+
+	m := New()
+	m.LoadProgram(addProgram)
+	var buf bytes.Buffer
+	m.Snapshot(&buf)
+	data := buf.Bytes()
+
+	future := append([]byte(nil), data...)
+	future[5] = SnapshotVersion + 1
+	if _, err := Restore(bytes.NewReader(future)); !errors.Is(err, ErrSnapshotVersion) {
+		t.Errorf("got %v, want ErrSnapshotVersion", err)
+	}
+	if _, err := Restore(bytes.NewReader(data[:1000])); err == nil {
+		t.Error("expected error restoring a truncated snapshot")
+	}
+
+	// the pending interrupts follow the header and memory, after their count
+	const pending = 17 + 65536
+	flooded := append([]byte(nil), data[:pending]...)
+	flooded = append(flooded, 0, InterruptQueueSize+1)
+	flooded = append(flooded, make([]byte, 2*(InterruptQueueSize+1))...)
+	flooded = append(flooded, data[pending+2:]...)
+	if _, err := Restore(bytes.NewReader(flooded)); err == nil {
+		t.Error("expected error restoring more pending interrupts than the queue holds")
+	}
+
+	// a corrupt device state length fails without allocating it
+	huge := append(append([]byte(nil), data[:pending+2]...), 1, 3, 0xFF, 0xFF, 0xFF, 0xFF, 0)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := Restore(bytes.NewReader(huge))
+	runtime.ReadMemStats(&after)
+	if err == nil {
+		t.Error("expected error restoring a truncated device state")
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<24 {
+		t.Errorf("allocated %d bytes restoring a truncated device state", n)
+	}
+
+	// saved device state needs a device to go into
+	m.RegisterDevice(3, NewInterruptController())
+	buf.Reset()
+	m.Snapshot(&buf)
+	if _, err := Restore(&buf); err == nil {
+		t.Error("expected error restoring device state with no device")
+	}
+}
@@ -4,5 +4,18 @@ import "testing"
 
 func TestStackOverflow(t *testing.T) {
 	m := New()
-	m.Run()
+	// push a byte and loop back forever
+	m.LoadProgram([]byte{
+		PushInstruction, 0x01,
+		Push16Instruction, 0x04, 0x00,
+		PushInstruction, 0x01,
+		JnzInstruction,
+	})
+	stop := m.RunFor(10000)
+	if stop.Reason != StopFaulted {
+		t.Fatalf("got %v, want faulted", stop.Reason)
+	}
+	if stop.State.Status != FlagFault|FlagStackOverflow {
+		t.Fatalf("got status %08b, want fault and stack overflow", stop.State.Status)
+	}
 }
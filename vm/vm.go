@@ -4,6 +4,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 type VM struct {
@@ -11,9 +13,34 @@ type VM struct {
 
 	pc uint16
 
-	interruptChan chan uint16
-
-	running bool
+	// mu is held by whichever goroutine is executing the machine. Everyone
+	// else goes through Post, which queues commands to be run between
+	// instructions.
+	mu     sync.Mutex
+	qmu    sync.Mutex
+	queue  []func(*VM)
+	queued atomic.Bool
+	wake   chan struct{}
+
+	// pending interrupts, guarded by qmu. inflight counts interrupts
+	// delivered but not yet applied.
+	pending     []uint16
+	inflight    int
+	overflowed  bool
+	interrupted atomic.Bool
+	controller  *InterruptController
+
+	replaying  atomic.Bool
+	inputHooks []func(uint64, Input)
+	wakeHooks  []func()
+
+	running  bool
+	started  bool
+	faulting bool
+	cycles   uint64
+
+	breakpoints map[uint16]bool
+	stopHooks   []func(Stop)
 
 	Debug bool
 }
@@ -26,17 +53,36 @@ const (
 	FlagReturnStackOverflow  = 0b00010000
 	FlagReturnStackUnderflow = 0b00100000
 	FlagDivideByZero         = 0b01000000
+	FlagInterruptOverflow    = 0b10000000
 )
 
 func (vm *VM) RegisterDevice(num int, device Device) {
+	if c, ok := vm.MMIO.devices[num].(*InterruptController); ok && c == vm.controller {
+		vm.controller = nil
+	}
+	if c, ok := device.(*InterruptController); ok {
+		c.vm = vm
+		vm.controller = c
+	}
 	vm.MMIO.devices[num] = device
 }
 
+// Device returns the device registered in slot num, or nil.
+func (vm *VM) Device(num int) Device {
+	return vm.MMIO.devices[num]
+}
+
 const (
 	AddrEntrypoint uint16 = 0x0000
 
 	AddrStatus uint16 = 0x0004
 
+	// extended fault register
+	AddrFaultCause  uint16 = 0x0005
+	AddrFaultPC     uint16 = 0x0006
+	AddrFaultOpcode uint16 = 0x0008
+	AddrFaultVector uint16 = 0x000A
+
 	AddrStackPointer uint16 = 0x0002
 	AddrStackStart   uint16 = 0x0100
 	AddrStackEnd     uint16 = 0x01FF
@@ -44,6 +90,8 @@ const (
 	AddrReturnStackPointer uint16 = 0x0003
 	AddrReturnStackStart   uint16 = 0x0200
 	AddrReturnStackEnd     uint16 = 0x02FF
+
+	AddrProgramStart uint16 = 0x0400
 )
 
 func New() *VM {
@@ -51,77 +99,93 @@ func New() *VM {
 		MMIO: &MMIO{
 			data: [65536]byte{},
 		},
-		interruptChan: make(chan uint16),
+		wake: make(chan struct{}, 1),
 	}
 }
 
 func (vm *VM) LoadProgram(data []byte) {
 	for i, b := range data {
-		vm.MMIO.WriteByte(uint16(i+0x400), b)
+		vm.MMIO.Write(AddrProgramStart+uint16(i), b)
 	}
-	vm.MMIO.WriteByte(0, 0x04)
+	vm.MMIO.Write(0, byte(AddrProgramStart>>8))
+	vm.MMIO.Write(1, byte(AddrProgramStart&0xFF))
 }
 
 func (vm *VM) PushStack(b byte) {
-	sp := uint16(vm.MMIO.ReadByte(AddrStackPointer))
+	if vm.faulting {
+		return
+	}
+	sp := uint16(vm.MMIO.Read(AddrStackPointer))
 	start := AddrStackStart
 	if sp > 0xFE {
-		vm.setFault(FlagStackOverflow)
+		vm.setFault(FaultStackOverflow)
 		return
 	}
-	vm.MMIO.WriteByte(start+sp, b)
-	vm.MMIO.WriteByte(AddrStackPointer, vm.MMIO.ReadByte(AddrStackPointer)+1)
+	vm.MMIO.Write(start+sp, b)
+	vm.MMIO.Write(AddrStackPointer, vm.MMIO.Read(AddrStackPointer)+1)
 }
 
 func (vm *VM) PopStack() byte {
-	sp := uint16(vm.MMIO.ReadByte(AddrStackPointer))
+	if vm.faulting {
+		return 0
+	}
+	sp := uint16(vm.MMIO.Read(AddrStackPointer))
 	if sp == 0x00 {
-		vm.setFault(FlagStackUnderflow)
+		vm.setFault(FaultStackUnderflow)
 		return 0
 	}
 	sp1 := sp - 1
 
-	b := vm.MMIO.ReadByte(AddrStackStart + sp1)
-	vm.MMIO.WriteByte(AddrStackPointer, vm.MMIO.ReadByte(AddrStackPointer)-1)
+	b := vm.MMIO.Read(AddrStackStart + sp1)
+	vm.MMIO.Write(AddrStackPointer, vm.MMIO.Read(AddrStackPointer)-1)
 	return b
 }
 func (vm *VM) PushStack16(b uint16) {
-	sp := uint16(vm.MMIO.ReadByte(AddrStackPointer))
+	if vm.faulting {
+		return
+	}
+	sp := uint16(vm.MMIO.Read(AddrStackPointer))
 	start := AddrStackStart
 	if sp >= 0xFE {
-		vm.setFault(FlagStackOverflow)
+		vm.setFault(FaultStackOverflow)
 		return
 	}
 	bs := make([]byte, 2)
 	binary.BigEndian.PutUint16(bs, b)
 
 	sp1 := sp + 1
-	vm.MMIO.WriteByte(start+sp, bs[0])
-	vm.MMIO.WriteByte(start+sp1, bs[1])
-	vm.MMIO.WriteByte(AddrStackPointer, vm.MMIO.ReadByte(AddrStackPointer)+2)
+	vm.MMIO.Write(start+sp, bs[0])
+	vm.MMIO.Write(start+sp1, bs[1])
+	vm.MMIO.Write(AddrStackPointer, vm.MMIO.Read(AddrStackPointer)+2)
 
 }
 
 func (vm *VM) PopStack16() uint16 {
-	sp := uint16(vm.MMIO.ReadByte(AddrStackPointer))
+	if vm.faulting {
+		return 0
+	}
+	sp := uint16(vm.MMIO.Read(AddrStackPointer))
 	start := AddrStackStart
 	if sp < 0x02 {
-		vm.setFault(FlagStackUnderflow)
+		vm.setFault(FaultStackUnderflow)
 		return 0
 	}
 	sp1 := sp - 1
 	sp2 := sp - 2
-	a := vm.MMIO.ReadByte(start + sp2)
-	b := vm.MMIO.ReadByte(start + sp1)
-	vm.MMIO.WriteByte(AddrStackPointer, vm.MMIO.ReadByte(AddrStackPointer)-2)
+	a := vm.MMIO.Read(start + sp2)
+	b := vm.MMIO.Read(start + sp1)
+	vm.MMIO.Write(AddrStackPointer, vm.MMIO.Read(AddrStackPointer)-2)
 	return (uint16(a) << 8) | uint16(b)
 }
 
 func (vm *VM) PushReturnStack(b uint16) {
-	sp := uint16(vm.MMIO.ReadByte(AddrReturnStackPointer))
+	if vm.faulting {
+		return
+	}
+	sp := uint16(vm.MMIO.Read(AddrReturnStackPointer))
 	start := AddrReturnStackStart
 	if sp >= 0xFE {
-		vm.setFault(FlagReturnStackOverflow)
+		vm.setFault(FaultReturnStackOverflow)
 		return
 	}
 	bs := make([]byte, 2)
@@ -129,76 +193,122 @@ func (vm *VM) PushReturnStack(b uint16) {
 
 	sp1 := sp + 1
 
-	vm.MMIO.WriteByte(start+sp, bs[0])
-	vm.MMIO.WriteByte(start+sp1, bs[1])
-	vm.MMIO.WriteByte(AddrReturnStackPointer, vm.MMIO.ReadByte(AddrReturnStackPointer)+2)
+	vm.MMIO.Write(start+sp, bs[0])
+	vm.MMIO.Write(start+sp1, bs[1])
+	vm.MMIO.Write(AddrReturnStackPointer, vm.MMIO.Read(AddrReturnStackPointer)+2)
 }
 
 func (vm *VM) PopReturnStack() uint16 {
-	sp := uint16(vm.MMIO.ReadByte(AddrReturnStackPointer))
+	if vm.faulting {
+		return 0
+	}
+	sp := uint16(vm.MMIO.Read(AddrReturnStackPointer))
 
 	start := AddrReturnStackStart
 	if sp < 0x02 {
-		vm.setFault(FlagReturnStackUnderflow)
+		vm.setFault(FaultReturnStackUnderflow)
 		return 0
 	}
 	sp1 := sp - 1
 	sp2 := sp - 2
-	a := vm.MMIO.ReadByte(start + sp2)
-	b := vm.MMIO.ReadByte(start + sp1)
-	vm.MMIO.WriteByte(AddrReturnStackPointer, vm.MMIO.ReadByte(AddrReturnStackPointer)-2)
+	a := vm.MMIO.Read(start + sp2)
+	b := vm.MMIO.Read(start + sp1)
+	vm.MMIO.Write(AddrReturnStackPointer, vm.MMIO.Read(AddrReturnStackPointer)-2)
 	return (uint16(a) << 8) | uint16(b)
 }
 
-func (vm *VM) setFault(flags byte) {
-	vm.MMIO.WriteByte(AddrStatus, flags|FlagFault)
-	vm.running = false
-}
-
 func (vm *VM) SetFlag(flag byte) {
-	vm.MMIO.WriteByte(AddrStatus, vm.MMIO.ReadByte(AddrStatus)|flag)
+	vm.MMIO.Write(AddrStatus, vm.MMIO.Read(AddrStatus)|flag)
 }
 
 func (vm *VM) CheckFlag(flag byte) bool {
-	return vm.MMIO.ReadByte(AddrStatus)&flag == flag
+	return vm.MMIO.Read(AddrStatus)&flag == flag
 }
 
 func (vm *VM) UnsetFlag(flag byte) {
-	vm.MMIO.WriteByte(AddrStatus, vm.MMIO.ReadByte(AddrStatus) & ^flag)
+	vm.MMIO.Write(AddrStatus, vm.MMIO.Read(AddrStatus) & ^flag)
 }
 
 func (vm *VM) advancePC(n uint16) {
 	vm.pc += n
 }
 
+// Run executes the machine on its own goroutine, sleeping in YIELD until an
+// interrupt arrives.
 func (vm *VM) Run() {
-	vm.pc = binary.BigEndian.Uint16(
-		[]byte{
-			vm.MMIO.ReadByte(0),
-			vm.MMIO.ReadByte(1),
-		},
-	)
-	vm.running = true
-
+	vm.Inspect(func(m *VM) {
+		if !m.started {
+			m.reset()
+		}
+	})
 	go func() {
-		for vm.running {
-			vm.execute(vm.MMIO.ReadByte(vm.pc))
-			if vm.CheckFlag(FlagWaiting) {
-				callbackPtr := <-vm.interruptChan
-
-				addr := make([]byte, 2)
-				addr[0] = vm.MMIO.ReadByte(callbackPtr)
-				addr[1] = vm.MMIO.ReadByte(callbackPtr + 1)
-				vm.pc = binary.BigEndian.Uint16(addr)
-				vm.UnsetFlag(FlagWaiting)
-				fmt.Println("continue")
+		vm.mu.Lock()
+		for {
+			stop := vm.run(nil, 0)
+			if stop.Reason != StopWaiting {
+				vm.release()
+				vm.notify(stop)
+				return
 			}
+			<-vm.wake
 		}
 	}()
 }
 
 func (vm *VM) Stop() {
-	vm.running = false
+	vm.Post(func(m *VM) {
+		m.running = false
+	})
+}
+
+// Post queues cmd to run on the machine between instructions. If nothing is
+// executing the machine, cmd runs before Post returns.
+func (vm *VM) Post(cmd func(*VM)) {
+	vm.qmu.Lock()
+	vm.queue = append(vm.queue, cmd)
+	vm.queued.Store(true)
+	vm.qmu.Unlock()
+
+	vm.signal()
+	if vm.mu.TryLock() {
+		vm.drain()
+		vm.release()
+	}
+}
+
+// Inspect runs fn with exclusive access to the machine and waits for it to
+// finish. It must not be called from a device of the same machine.
+func (vm *VM) Inspect(fn func(*VM)) {
+	done := make(chan struct{})
+	vm.Post(func(m *VM) {
+		fn(m)
+		close(done)
+	})
+	<-done
+}
+
+func (vm *VM) drain() {
+	if !vm.queued.Load() {
+		return
+	}
+	vm.qmu.Lock()
+	cmds := vm.queue
+	vm.queue = nil
+	vm.queued.Store(false)
+	vm.qmu.Unlock()
+	for _, cmd := range cmds {
+		cmd(vm)
+	}
+}
+
+// release gives up execution, first picking up any commands posted by
+// goroutines that found the machine busy.
+func (vm *VM) release() {
+	vm.mu.Unlock()
+	for vm.queued.Load() && vm.mu.TryLock() {
+		vm.drain()
+		vm.mu.Unlock()
+	}
 }
 
 func (vm *VM) execute(instr byte) {
@@ -309,7 +419,7 @@ func (vm *VM) execute(instr byte) {
 		b := vm.PopStack()
 		a := vm.PopStack()
 		if a == 0 {
-			vm.setFault(FlagDivideByZero)
+			vm.setFault(FaultDivideByZero)
 			return
 		}
 		vm.PushStack(b / a)
@@ -318,7 +428,7 @@ func (vm *VM) execute(instr byte) {
 		b := vm.PopStack16()
 		a := vm.PopStack16()
 		if a == 0 {
-			vm.setFault(FlagDivideByZero)
+			vm.setFault(FaultDivideByZero)
 			return
 		}
 		vm.PushStack16(b / a)
@@ -327,7 +437,7 @@ func (vm *VM) execute(instr byte) {
 		b := vm.PopStack()
 		a := vm.PopStack()
 		if a == 0 {
-			vm.setFault(FlagDivideByZero)
+			vm.setFault(FaultDivideByZero)
 			return
 		}
 		vm.PushStack(b % a)
@@ -336,7 +446,7 @@ func (vm *VM) execute(instr byte) {
 		b := vm.PopStack16()
 		a := vm.PopStack16()
 		if a == 0 {
-			vm.setFault(FlagDivideByZero)
+			vm.setFault(FaultDivideByZero)
 			return
 		}
 		vm.PushStack16(b % a)
@@ -437,6 +547,11 @@ func (vm *VM) execute(instr byte) {
 		vm.pc = addr
 	case RetInstruction:
 		vm.pc = vm.PopReturnStack()
+	case RetiInstruction:
+		vm.pc = vm.PopReturnStack()
+		if vm.controller != nil && !vm.faulting {
+			vm.controller.endOfInterrupt()
+		}
 	case EqInstruction:
 		b := vm.PopStack()
 		a := vm.PopStack()
@@ -510,11 +625,11 @@ func (vm *VM) execute(instr byte) {
 		vm.PushStack(byte(c))
 		vm.advancePC(1)
 	case PushInstruction:
-		a := vm.MMIO.ReadByte(vm.pc + 1)
+		a := vm.MMIO.Read(vm.pc + 1)
 		vm.PushStack(a)
 		vm.advancePC(2)
 	case Push16Instruction:
-		a, b := vm.MMIO.ReadByte(vm.pc+1), vm.MMIO.ReadByte(vm.pc+2)
+		a, b := vm.MMIO.Read(vm.pc+1), vm.MMIO.Read(vm.pc+2)
 		vm.PushStack16(binary.BigEndian.Uint16([]byte{a, b}))
 		vm.advancePC(3)
 	case StoreInstruction:
@@ -523,30 +638,31 @@ func (vm *VM) execute(instr byte) {
 		if vm.Debug {
 			fmt.Printf("%x - %x\n", addr, c)
 		}
-		vm.MMIO.WriteByte(addr, c)
+		if !vm.faulting {
+			vm.MMIO.Write(addr, c)
+		}
 		vm.advancePC(1)
 	case Store16Instruction:
 		b := vm.PopStack()
 		a := vm.PopStack()
 		addr := vm.PopStack16()
-		vm.MMIO.WriteByte(addr, a)
-		vm.MMIO.WriteByte(addr+1, b)
+		if !vm.faulting {
+			vm.MMIO.Write(addr, a)
+			vm.MMIO.Write(addr+1, b)
+		}
 		vm.advancePC(1)
 	case LoadInstruction:
 		addr := vm.PopStack16()
-		vm.PushStack(vm.MMIO.ReadByte(addr))
+		vm.PushStack(vm.MMIO.Read(addr))
 		vm.advancePC(1)
 	case Load16Instruction:
 		addr := vm.PopStack16()
-		b := vm.MMIO.ReadByte(addr)
-		a := vm.MMIO.ReadByte(addr + 1)
+		b := vm.MMIO.Read(addr)
+		a := vm.MMIO.Read(addr + 1)
 		vm.PushStack(b)
 		vm.PushStack(a)
 		vm.advancePC(1)
+	default:
+		vm.setFault(FaultInvalidOpcode)
 	}
 }
-
-func (vm *VM) Interrupt(callbackPtr uint16) error {
-	vm.interruptChan <- callbackPtr
-	return nil
-}